@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Stores bundles the storage backends of an App. DB is only set if one of
+// the stores is backed by the sql database.
+type Stores struct {
+	DB       *DB
+	Users    UserStore
+	Sessions SessionStore
+	Images   ImageStore
+	Blobs    BlobStore
+}
+
+// App owns the configuration, stores, templates and router of a Gophr
+// instance. Handlers are methods on App, so an App can be built from any
+// store implementation and driven through its Handler.
+type App struct {
+	*Stores
+	Config  *Config
+	Logger  *Logger
+	Metrics *Metrics
+	Fetcher *ImageFetcher
+
+	templates *template.Template
+	layout    *template.Template
+	handler   http.Handler
+}
+
+// OpenStores connects to the database and creates the stores selected by
+// the configuration
+func OpenStores(config *Config, logger *Logger) (*Stores, error) {
+	db, err := NewDB(config.Database.Driver, config.Database.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to the database: %s", err)
+	}
+	logger.Info("database opened",
+		"driver", config.Database.Driver,
+		"dsn", describeDSN(config.Database.Driver, config.Database.DSN),
+	)
+
+	stores := &Stores{
+		DB:     db,
+		Images: NewDBImageStore(db, logger.With("store", "images")),
+	}
+
+	if config.UserStore.Backend == "file" {
+		stores.Users, err = NewFileUserStore(config.UserStore.File, logger.With("store", "users"))
+		if err != nil {
+			return nil, fmt.Errorf("Error creating user store: %s", err)
+		}
+	} else {
+		stores.Users = NewDBUserStore(db, logger.With("store", "users"))
+	}
+
+	if config.SessionStore.Backend == "file" {
+		stores.Sessions, err = NewFileSessionStore(config.SessionStore.File, logger.With("store", "sessions"))
+		if err != nil {
+			return nil, fmt.Errorf("Error creating session store: %s", err)
+		}
+	} else {
+		stores.Sessions = NewDBSessionStore(db, logger.With("store", "sessions"))
+	}
+
+	stores.Blobs, err = NewBlobStore(config.BlobStore)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating blob store: %s", err)
+	}
+
+	return stores, nil
+}
+
+// Close releases the resources held by the stores
+func (stores *Stores) Close() error {
+	if stores.DB == nil {
+		return nil
+	}
+	return stores.DB.Close()
+}
+
+// NewApp returns an App serving from the given stores, which are
+// instrumented for the metrics. The templates are loaded from the templates
+// directory.
+func NewApp(config *Config, stores *Stores, logger *Logger) (*App, error) {
+	metrics := NewMetrics()
+	app := &App{
+		Stores:  instrumentStores(stores, metrics),
+		Config:  config,
+		Logger:  logger,
+		Metrics: metrics,
+		Fetcher: NewImageFetcher(config.Fetcher, logger.With("component", "fetcher")),
+	}
+	app.registerSessionGauges()
+
+	err := app.loadTemplates("templates")
+	if err != nil {
+		return nil, err
+	}
+
+	app.handler = app.routes()
+	return app, nil
+}
+
+// ServeHTTP lets the App handle requests
+func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	app.handler.ServeHTTP(w, r)
+}
+
+// MetricsHandler returns the handler of the internal metrics server, which
+// serves the metrics on /metrics
+func (app *App) MetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", app.Metrics)
+	return mux
+}
+
+// loadTemplates parses the layout and page templates in the directory
+func (app *App) loadTemplates(dir string) error {
+	templates, err := template.New("t").ParseGlob(filepath.Join(dir, "**", "*.html"))
+	if err != nil {
+		return fmt.Errorf("Error parsing templates: %s", err)
+	}
+
+	layout, err := template.New("layout.html").Funcs(layoutFuncs).ParseFiles(filepath.Join(dir, "layout.html"))
+	if err != nil {
+		return fmt.Errorf("Error parsing layout: %s", err)
+	}
+
+	app.templates = templates
+	app.layout = layout
+	return nil
+}
+
+// routes registers all handlers and returns them wrapped in the middleware
+// chain
+func (app *App) routes() http.Handler {
+	router := NewRouter()
+	router.NotFound = http.HandlerFunc(app.NotFound)
+
+	// handle registers the handle and records its path as the request's
+	// route for the metrics
+	handle := func(method, path string, handle httprouter.Handle) {
+		router.Handle(method, path, func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+			if record := requestRecordOf(r); record != nil {
+				record.Route = path
+			}
+			handle(w, r, params)
+		})
+	}
+
+	handle("GET", "/", app.HandleHome)
+	handle("GET", "/register", app.HandleUserNew)
+	handle("POST", "/register", app.HandleUserCreate)
+	handle("GET", "/login", app.HandleSessionNew)
+	handle("POST", "/login", app.HandleSessionCreate)
+	handle("GET", "/image/:imageID", app.HandleImageShow)
+	handle("GET", "/im/:location", app.HandleImageFile)
+	handle("GET", "/user/:userID", app.HandleUserShow)
+	handle("GET", "/assets/*filepath", serveFiles(http.Dir("assets/")))
+	handle("GET", "/healthz", app.HandleHealthz)
+	handle("GET", "/readyz", app.HandleReadyz)
+
+	handle("POST", "/signout", app.secure(app.HandleSessionDestroy))
+	handle("GET", "/account", app.secure(app.HandleUserEdit))
+	handle("POST", "/account", app.secure(app.HandleUserUpdate))
+	handle("GET", "/account/sessions", app.secure(app.HandleSessionList))
+	handle("POST", "/account/sessions/revoke", app.secure(app.HandleSessionRevoke))
+	handle("POST", "/account/sessions/revoke-others", app.secure(app.HandleSessionRevokeOthers))
+	handle("GET", "/images/new", app.secure(app.HandleImageNew))
+	handle("POST", "/images/new", app.secure(app.HandleImageCreate))
+
+	return Chain(router,
+		RequestIDMiddleware,
+		app.AccessLog,
+		app.Metrics.Middleware,
+		app.Recover,
+		app.LimitRequestBody,
+		app.Authenticate,
+		app.CSRF,
+	)
+}
+
+// serveFiles returns a handle serving the files of root by the *filepath
+// parameter, like httprouter's ServeFiles. The file server gets a copy of
+// the url, so the middlewares still see the requested path.
+func serveFiles(root http.FileSystem) httprouter.Handle {
+	fileServer := http.FileServer(root)
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		fileURL := *r.URL
+		fileURL.Path = params.ByName("filepath")
+
+		fileRequest := r.WithContext(r.Context())
+		fileRequest.URL = &fileURL
+		fileServer.ServeHTTP(w, fileRequest)
+	}
+}
+
+// registerSessionGauges adds gauges of the active sessions to the metrics,
+// if the session store is able to count them
+func (app *App) registerSessionGauges() {
+	counter, ok := app.Sessions.(ActiveSessionCounter)
+	if !ok {
+		return
+	}
+
+	app.Metrics.NewGaugeFunc("gophr_active_sessions", "Number of sessions which haven't expired.", func() (float64, error) {
+		sessions, _, err := counter.CountActive(time.Now())
+		return float64(sessions), err
+	})
+	app.Metrics.NewGaugeFunc("gophr_active_session_users", "Number of users with a session which hasn't expired.", func() (float64, error) {
+		_, users, err := counter.CountActive(time.Now())
+		return float64(users), err
+	})
+}
+
+// secure wraps a router handle with the RequireLogin middleware
+func (app *App) secure(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handle(w, r, params)
+		})
+		app.RequireLogin(handler).ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes the data to a temporary file next to the target,
+// flushes it to disk and renames it over the target. A crash at any point
+// leaves either the old or the new contents behind, never a partial file.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filename)
+	tempFile, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	// Clean up after any failure, after the rename this is a no-op
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if err == nil {
+		err = tempFile.Chmod(perm)
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tempFile.Name(), filename)
+	if err != nil {
+		return err
+	}
+
+	// Persist the rename itself by syncing the directory
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
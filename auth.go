@@ -7,6 +7,6 @@ import "net/http"
 func AuthenticateRequest(w http.ResponseWriter, r *http.Request) {
 	authenticated := false
 	if !authenticated {
-		http.Redirect(w, r, "/register", http.StatusFound)
+		Redirect(w, r, "/register", "")
 	}
 }
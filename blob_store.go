@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// BlobStore is an abstraction interface for the storage backend holding the
+// image files
+type BlobStore interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadSeekCloser, error)
+	Delete(key string) error
+	Stat(key string) (*BlobInfo, error)
+	SignedURL(key string, expiry time.Duration) (string, error)
+}
+
+// BlobInfo contains the metadata of a stored blob
+type BlobInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// BlobStoreConfig selects and configures the blob storage backend
+type BlobStoreConfig struct {
+	// Backend is either "file" or "s3"
+	Backend string `yaml:"backend"`
+	// Directory is the base directory of the file backend
+	Directory string   `yaml:"directory"`
+	S3        S3Config `yaml:"s3"`
+}
+
+var (
+	errBlobNotFound          = errors.New("blob not found")
+	errSignedURLNotSupported = errors.New("blob store doesn't support signed urls")
+)
+
+// NewBlobStore returns the blob store backend selected by the configuration
+func NewBlobStore(config BlobStoreConfig) (BlobStore, error) {
+	switch config.Backend {
+	case "", "file":
+		return NewFileBlobStore(config.Directory)
+	case "s3":
+		return NewS3BlobStore(config.S3)
+	}
+	return nil, fmt.Errorf("Unknown blob store backend %q", config.Backend)
+}
+
+// FileBlobStore is a local filesystem implementation of the BlobStore interface
+type FileBlobStore struct {
+	directory string
+}
+
+// NewFileBlobStore returns a FileBlobStore storing its blobs in the given
+// directory, which is created if it doesn't exist yet
+func NewFileBlobStore(directory string) (*FileBlobStore, error) {
+	err := os.MkdirAll(directory, 0770)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileBlobStore{
+		directory: directory,
+	}, nil
+}
+
+// Put writes the blob to a temporary file first and moves it into place
+// afterwards, so readers never see a partially written blob
+func (store *FileBlobStore) Put(key string, r io.Reader) error {
+	tempFile, err := ioutil.TempFile(store.directory, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = io.Copy(tempFile, r)
+	if err != nil {
+		tempFile.Close()
+		return err
+	}
+
+	err = tempFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), store.path(key))
+}
+
+// Get opens the blob with the given key or returns errBlobNotFound
+func (store *FileBlobStore) Get(key string) (io.ReadSeekCloser, error) {
+	file, err := os.Open(store.path(key))
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Delete removes the blob, deleting a missing blob is not an error
+func (store *FileBlobStore) Delete(key string) error {
+	err := os.Remove(store.path(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Stat returns the metadata of the blob or errBlobNotFound
+func (store *FileBlobStore) Stat(key string) (*BlobInfo, error) {
+	info, err := os.Stat(store.path(key))
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlobInfo{
+		Key:         key,
+		Size:        info.Size(),
+		ContentType: mime.TypeByExtension(filepath.Ext(key)),
+		ModTime:     info.ModTime(),
+	}, nil
+}
+
+// SignedURL isn't supported by the file backend, its blobs are served by
+// the application itself
+func (store *FileBlobStore) SignedURL(key string, expiry time.Duration) (string, error) {
+	return "", errSignedURLNotSupported
+}
+
+// path returns the file name of the blob, removing any directory components
+// from the key so it can't escape the store's directory
+func (store *FileBlobStore) path(key string) string {
+	return filepath.Join(store.directory, filepath.Base(key))
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-yaml/yaml"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Config holds all settings of the application. The settings are read from
+// a YAML file, environment variables and command line flags, each one
+// overriding the former.
+type Config struct {
+	ListenAddress string `yaml:"listen_address"`
+	// MetricsAddress is the internal address /metrics is served on, the
+	// metrics are disabled if it's empty
+	MetricsAddress string `yaml:"metrics_address"`
+
+	// Timeouts of the HTTP server, see http.Server
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// ShutdownTimeout is how long in-flight requests may take to finish
+	// when the server is shut down
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	Database     DatabaseConfig  `yaml:"database"`
+	UserStore    StoreConfig     `yaml:"user_store"`
+	SessionStore StoreConfig     `yaml:"session_store"`
+	BlobStore    BlobStoreConfig `yaml:"blob_store"`
+	Fetcher      FetcherConfig   `yaml:"fetcher"`
+	Log          LogConfig       `yaml:"log"`
+
+	SessionCookie CookieConfig `yaml:"session_cookie"`
+	// SessionLength is how long remembered users stay signed in without
+	// any activity, SessionIdleTimeout the same for everybody else
+	SessionLength      time.Duration `yaml:"session_length"`
+	SessionIdleTimeout time.Duration `yaml:"session_idle_timeout"`
+	// SessionMaxLifetime is how long a session lasts at most, no matter
+	// how active it is
+	SessionMaxLifetime time.Duration `yaml:"session_max_lifetime"`
+
+	PasswordLength int `yaml:"password_length"`
+	HashCost       int `yaml:"hash_cost"`
+	PageSize       int `yaml:"page_size"`
+	// UploadMaxBytes is the size limit of uploaded image files
+	UploadMaxBytes int64 `yaml:"upload_max_bytes"`
+}
+
+// DatabaseConfig selects the sql database
+type DatabaseConfig struct {
+	// Driver is either "mysql" or "sqlite"
+	Driver string `yaml:"driver"`
+	// DSN is the data source name for MySQL or the file name for SQLite
+	DSN string `yaml:"dsn"`
+}
+
+// StoreConfig selects the backend of the user or session store
+type StoreConfig struct {
+	// Backend is either "sql" or "file"
+	Backend string `yaml:"backend"`
+	// File is the yaml file used by the file backend
+	File string `yaml:"file"`
+}
+
+// CookieConfig holds the attributes of the session cookie
+type CookieConfig struct {
+	Path string `yaml:"path"`
+	// Secure restricts the cookie to https, which should be enabled
+	// whenever Gophr is served over https
+	Secure   bool `yaml:"secure"`
+	HTTPOnly bool `yaml:"http_only"`
+	// SameSite is either "lax", "strict" or "none"
+	SameSite string `yaml:"same_site"`
+	// Secret signs the cookie values with HMAC-SHA256 if it isn't empty,
+	// so forged session IDs are rejected without a store lookup
+	Secret string `yaml:"secret"`
+}
+
+// DefaultConfig returns the configuration used for all settings which
+// aren't configured otherwise
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddress: ":3000",
+		// Uploads of large images on slow connections take a while
+		ReadTimeout:     60 * time.Second,
+		WriteTimeout:    60 * time.Second,
+		IdleTimeout:     120 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		// Existing users live in the file until they're imported with
+		// "gophr migrate import-users"
+		UserStore: StoreConfig{
+			Backend: "file",
+			File:    "./data/users.yaml",
+		},
+		SessionStore: StoreConfig{
+			Backend: "sql",
+			File:    "./data/sessions.yaml",
+		},
+		BlobStore: BlobStoreConfig{
+			Backend:   "file",
+			Directory: "./data/images",
+		},
+		Fetcher: FetcherConfig{
+			ConnectTimeout: 5 * time.Second,
+			Timeout:        30 * time.Second,
+			MaxBytes:       20 << 20,
+			MaxRedirects:   5,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "logfmt",
+			Output: "stderr",
+		},
+		SessionCookie: CookieConfig{
+			Path:     "/",
+			HTTPOnly: true,
+			SameSite: "lax",
+		},
+		// Keep remembered users logged in for 3 days of inactivity, everyone
+		// else for 2 hours, and nobody longer than 30 days
+		SessionLength:      24 * 3 * time.Hour,
+		SessionIdleTimeout: 2 * time.Hour,
+		SessionMaxLifetime: 30 * 24 * time.Hour,
+		PasswordLength:     8,
+		HashCost:           10,
+		PageSize:           25,
+		UploadMaxBytes:     20 << 20,
+	}
+}
+
+// LoadConfig builds the configuration from the defaults, the YAML file given
+// by the -config flag or GOPHR_CONFIG, the GOPHR_* environment variables and
+// the command line flags, in that order of precedence. The arguments left
+// after the flags are returned as well.
+func LoadConfig(args []string) (*Config, []string, error) {
+	// Parse the flags first to find the config file, they are applied
+	// last though, as they take precedence over everything else
+	flags := newConfigFlagSet(DefaultConfig())
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	setFlags := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	config := DefaultConfig()
+	filename := os.Getenv("GOPHR_CONFIG")
+	if name, ok := setFlags["config"]; ok {
+		filename = name
+	}
+	if filename != "" {
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error reading config file: %s", err)
+		}
+		err = yaml.UnmarshalStrict(contents, config)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error parsing config file %s: %s", filename, err)
+		}
+	}
+
+	overrides := newConfigFlagSet(config)
+	var envErr error
+	overrides.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(configEnvName(f.Name))
+		if !ok || f.Name == "config" || envErr != nil {
+			return
+		}
+		err := overrides.Set(f.Name, value)
+		if err != nil {
+			envErr = fmt.Errorf("Invalid value for %s: %s", configEnvName(f.Name), err)
+		}
+	})
+	if envErr != nil {
+		return nil, nil, envErr
+	}
+
+	for name, value := range setFlags {
+		if name == "config" {
+			continue
+		}
+		err := overrides.Set(name, value)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return config, flags.Args(), config.Validate()
+}
+
+// newConfigFlagSet returns a flag set whose flags write directly into the
+// config. Every flag can also be set by the environment variable returned
+// by configEnvName.
+func newConfigFlagSet(config *Config) *flag.FlagSet {
+	flags := flag.NewFlagSet("gophr", flag.ContinueOnError)
+	flags.String("config", "", "YAML file to read the configuration from")
+
+	flags.StringVar(&config.ListenAddress, "listen", config.ListenAddress, "address the HTTP server listens on")
+	flags.StringVar(&config.MetricsAddress, "metrics-listen", config.MetricsAddress, "internal address serving /metrics, disabled if empty")
+	flags.DurationVar(&config.ReadTimeout, "read-timeout", config.ReadTimeout, "maximum duration for reading a request including its body")
+	flags.DurationVar(&config.WriteTimeout, "write-timeout", config.WriteTimeout, "maximum duration for writing a response")
+	flags.DurationVar(&config.IdleTimeout, "idle-timeout", config.IdleTimeout, "how long idle keep-alive connections are kept open")
+	flags.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", config.ShutdownTimeout, "how long in-flight requests may take when shutting down")
+	flags.StringVar(&config.Database.Driver, "database-driver", config.Database.Driver, "sql database driver, mysql or sqlite")
+	flags.StringVar(&config.Database.DSN, "database-dsn", config.Database.DSN, "MySQL data source name or SQLite file name")
+	flags.StringVar(&config.UserStore.Backend, "user-store", config.UserStore.Backend, "user store backend, sql or file")
+	flags.StringVar(&config.UserStore.File, "user-store-file", config.UserStore.File, "yaml file of the file user store")
+	flags.StringVar(&config.SessionStore.Backend, "session-store", config.SessionStore.Backend, "session store backend, sql or file")
+	flags.StringVar(&config.SessionStore.File, "session-store-file", config.SessionStore.File, "yaml file of the file session store")
+	flags.StringVar(&config.BlobStore.Backend, "blob-store", config.BlobStore.Backend, "image file storage backend, file or s3")
+	flags.StringVar(&config.BlobStore.Directory, "blob-store-directory", config.BlobStore.Directory, "directory of the file blob store")
+	flags.StringVar(&config.BlobStore.S3.Endpoint, "s3-endpoint", config.BlobStore.S3.Endpoint, "base url of the S3 service")
+	flags.StringVar(&config.BlobStore.S3.Region, "s3-region", config.BlobStore.S3.Region, "S3 region")
+	flags.StringVar(&config.BlobStore.S3.Bucket, "s3-bucket", config.BlobStore.S3.Bucket, "S3 bucket")
+	flags.StringVar(&config.BlobStore.S3.AccessKey, "s3-access-key", config.BlobStore.S3.AccessKey, "S3 access key")
+	flags.StringVar(&config.BlobStore.S3.SecretKey, "s3-secret-key", config.BlobStore.S3.SecretKey, "S3 secret key")
+	flags.DurationVar(&config.Fetcher.ConnectTimeout, "fetch-connect-timeout", config.Fetcher.ConnectTimeout, "connect timeout when downloading images")
+	flags.DurationVar(&config.Fetcher.Timeout, "fetch-timeout", config.Fetcher.Timeout, "total timeout when downloading images")
+	flags.Int64Var(&config.Fetcher.MaxBytes, "fetch-max-bytes", config.Fetcher.MaxBytes, "maximum size of downloaded images")
+	flags.IntVar(&config.Fetcher.MaxRedirects, "fetch-max-redirects", config.Fetcher.MaxRedirects, "maximum number of redirects when downloading images")
+	flags.Var((*stringList)(&config.Fetcher.AllowedHosts), "fetch-allowed-hosts", "comma separated hosts images may be downloaded from")
+	flags.Var((*stringList)(&config.Fetcher.DeniedHosts), "fetch-denied-hosts", "comma separated hosts images must not be downloaded from")
+	flags.StringVar(&config.Log.Level, "log-level", config.Log.Level, "minimum log level, debug, info, warn or error")
+	flags.StringVar(&config.Log.Format, "log-format", config.Log.Format, "log format, json or logfmt")
+	flags.StringVar(&config.Log.Output, "log-output", config.Log.Output, "stderr, stdout or a file logs are appended to")
+	flags.StringVar(&config.SessionCookie.Path, "cookie-path", config.SessionCookie.Path, "path of the session cookie")
+	flags.BoolVar(&config.SessionCookie.Secure, "cookie-secure", config.SessionCookie.Secure, "send the session cookie over https only")
+	flags.BoolVar(&config.SessionCookie.HTTPOnly, "cookie-http-only", config.SessionCookie.HTTPOnly, "hide the session cookie from javascript")
+	flags.StringVar(&config.SessionCookie.SameSite, "cookie-same-site", config.SessionCookie.SameSite, "SameSite mode of the session cookie, lax, strict or none")
+	flags.StringVar(&config.SessionCookie.Secret, "cookie-secret", config.SessionCookie.Secret, "secret signing the session cookie, unsigned if empty")
+	flags.DurationVar(&config.SessionLength, "session-length", config.SessionLength, "how long remembered users stay logged in without activity")
+	flags.DurationVar(&config.SessionIdleTimeout, "session-idle-timeout", config.SessionIdleTimeout, "how long users who aren't remembered stay logged in without activity")
+	flags.DurationVar(&config.SessionMaxLifetime, "session-max-lifetime", config.SessionMaxLifetime, "how long users stay logged in at most")
+	flags.IntVar(&config.PasswordLength, "password-length", config.PasswordLength, "minimum password length")
+	flags.IntVar(&config.HashCost, "hash-cost", config.HashCost, "bcrypt cost of password hashes")
+	flags.IntVar(&config.PageSize, "page-size", config.PageSize, "number of images per page")
+	flags.Int64Var(&config.UploadMaxBytes, "upload-max-bytes", config.UploadMaxBytes, "maximum size of uploaded images")
+
+	return flags
+}
+
+// configEnvName returns the environment variable of the flag with the given
+// name, e.g. GOPHR_DATABASE_DSN for -database-dsn
+func configEnvName(flagName string) string {
+	return "GOPHR_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// Validate checks the configuration and returns an error listing all
+// invalid settings
+func (config *Config) Validate() error {
+	problems := []string{}
+	check := func(valid bool, format string, args ...interface{}) {
+		if !valid {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(config.ListenAddress != "", "listen_address must not be empty")
+	check(config.MetricsAddress == "" || config.MetricsAddress != config.ListenAddress,
+		"metrics_address must differ from listen_address, the metrics must not be public")
+	check(config.ReadTimeout > 0, "read_timeout must be positive")
+	check(config.WriteTimeout > 0, "write_timeout must be positive")
+	check(config.IdleTimeout > 0, "idle_timeout must be positive")
+	check(config.ShutdownTimeout > 0, "shutdown_timeout must be positive")
+
+	// There's no default database, starting on an empty one by accident
+	// would look like all images were lost
+	switch config.Database.Driver {
+	case "mysql", "sqlite":
+	case "":
+		check(false, "database.driver must be set to mysql or sqlite")
+	default:
+		check(false, "database.driver must be mysql or sqlite, not %q", config.Database.Driver)
+	}
+	check(config.Database.DSN != "", "database.dsn must not be empty")
+
+	for name, store := range map[string]StoreConfig{"user_store": config.UserStore, "session_store": config.SessionStore} {
+		check(store.Backend == "sql" || store.Backend == "file",
+			"%s.backend must be sql or file, not %q", name, store.Backend)
+		check(store.Backend != "file" || store.File != "", "%s.file must not be empty", name)
+	}
+
+	switch config.BlobStore.Backend {
+	case "file":
+		check(config.BlobStore.Directory != "", "blob_store.directory must not be empty")
+	case "s3":
+		check(config.BlobStore.S3.Endpoint != "", "blob_store.s3.endpoint must not be empty")
+		check(config.BlobStore.S3.Bucket != "", "blob_store.s3.bucket must not be empty")
+	default:
+		check(false, "blob_store.backend must be file or s3, not %q", config.BlobStore.Backend)
+	}
+
+	check(config.Fetcher.ConnectTimeout > 0, "fetcher.connect_timeout must be positive")
+	check(config.Fetcher.Timeout > 0, "fetcher.timeout must be positive")
+	check(config.Fetcher.MaxBytes > 0, "fetcher.max_bytes must be positive")
+	check(config.Fetcher.MaxRedirects >= 0, "fetcher.max_redirects must not be negative")
+
+	_, err := ParseLogLevel(config.Log.Level)
+	check(err == nil, "log.level must be debug, info, warn or error, not %q", config.Log.Level)
+	check(config.Log.Format == "json" || config.Log.Format == "logfmt",
+		"log.format must be json or logfmt, not %q", config.Log.Format)
+	check(config.Log.Output != "", "log.output must not be empty")
+
+	check(strings.HasPrefix(config.SessionCookie.Path, "/"), "session_cookie.path must start with /")
+	_, ok := sameSiteModes[config.SessionCookie.SameSite]
+	check(ok, "session_cookie.same_site must be lax, strict or none, not %q", config.SessionCookie.SameSite)
+	check(config.SessionCookie.SameSite != "none" || config.SessionCookie.Secure,
+		"session_cookie.same_site none requires session_cookie.secure")
+	check(config.SessionCookie.Secret == "" || len(config.SessionCookie.Secret) >= minCookieSecretLength,
+		"session_cookie.secret must be at least %d characters long", minCookieSecretLength)
+
+	check(config.SessionLength > 0, "session_length must be positive")
+	check(config.SessionIdleTimeout > 0, "session_idle_timeout must be positive")
+	check(config.SessionMaxLifetime >= config.SessionLength && config.SessionMaxLifetime >= config.SessionIdleTimeout,
+		"session_max_lifetime must not be shorter than session_length and session_idle_timeout")
+	check(config.PasswordLength > 0, "password_length must be positive")
+	check(config.HashCost >= bcrypt.MinCost && config.HashCost <= bcrypt.MaxCost,
+		"hash_cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	check(config.PageSize > 0 && config.PageSize <= 1000, "page_size must be between 1 and 1000")
+	check(config.UploadMaxBytes > 0, "upload_max_bytes must be positive")
+
+	if len(problems) > 0 {
+		return errors.New("Invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// stringList is a flag.Value of comma separated strings
+type stringList []string
+
+func (list *stringList) String() string {
+	if list == nil {
+		return ""
+	}
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = nil
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			*list = append(*list, item)
+		}
+	}
+	return nil
+}
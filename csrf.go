@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+const (
+	csrfFieldName  = "csrf_token"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfTokenBytes = 32
+)
+
+// generateCSRFToken returns a new random token for a session
+func generateCSRFToken() string {
+	token := make([]byte, csrfTokenBytes)
+	rand.Read(token)
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// CSRF is a middleware which rejects requests with unsafe methods unless
+// they carry the CSRF token of their session, either as form value or as
+// X-CSRF-Token header
+func (app *App) CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS", "TRACE":
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := r.Header.Get(csrfHeaderName)
+		if token == "" {
+			// The form can't be read if the body exceeds the upload limit
+			err := r.ParseMultipartForm(maxFormMemory)
+			if isRequestTooLarge(err) {
+				app.RenderError(w, r, http.StatusRequestEntityTooLarge)
+				return
+			}
+			token = r.FormValue(csrfFieldName)
+		}
+
+		session := RequestSession(r)
+		if session == nil || session.CSRFToken == "" ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) != 1 {
+			app.Logger.Warn("csrf token rejected",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"request_id", RequestID(r),
+				"has_session", session != nil,
+			)
+			app.RenderError(w, r, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CSRFToken returns the CSRF token of the request's session or an empty
+// string if it has none. Sessions created before tokens existed get one.
+func (app *App) CSRFToken(r *http.Request) string {
+	session := RequestSession(r)
+	if session == nil {
+		return ""
+	}
+
+	if session.CSRFToken == "" {
+		session.CSRFToken = generateCSRFToken()
+		err := app.Sessions.Save(session)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return session.CSRFToken
+}
+
+// EnsureSession starts an anonymous session if the request has none, so
+// forms shown to visitors who aren't signed in carry a CSRF token as well.
+// The returned request carries the session.
+func (app *App) EnsureSession(w http.ResponseWriter, r *http.Request) *http.Request {
+	if RequestSession(r) != nil {
+		return r
+	}
+
+	session := app.NewSession(w, r, false)
+	err := app.Sessions.Save(session)
+	if err != nil {
+		panic(err)
+	}
+	return withSession(r, session, nil)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// DB is a sql database together with the dialect of its driver, so the same
+// store code runs on every supported database
+type DB struct {
+	*sql.DB
+	Dialect Dialect
+}
+
+// Dialect abstracts the differences between the supported sql databases
+type Dialect interface {
+	// Name returns the name of the driver, which is also the name of the
+	// directory holding its migrations
+	Name() string
+
+	// Replace returns a statement inserting a row into the table, which
+	// replaces an existing row with the same primary key
+	Replace(table string, columns ...string) string
+
+	// LimitOffset returns the clause restricting a query to a page of
+	// results, taking the limit and offset as parameters
+	LimitOffset() string
+
+	// Timestamp converts a time into the representation stored in the
+	// database, so stored timestamps compare correctly
+	Timestamp(t time.Time) time.Time
+
+	// IsDuplicateKeyError returns true if the error was caused by a
+	// violation of a unique index
+	IsDuplicateKeyError(err error) bool
+
+	// TableSchema returns the names of the table's columns and indexes,
+	// which are both empty if the table doesn't exist
+	TableSchema(conn *sql.Conn, table string) (columns, indexes map[string]bool, err error)
+
+	// Lock acquires an exclusive lock with the given name on the connection
+	// and returns a function releasing it. Dialects holding the lock in a
+	// transaction commit the changes made meanwhile if commit is true and
+	// roll them back otherwise.
+	Lock(conn *sql.Conn, name string, timeout time.Duration) (release func(commit bool), err error)
+}
+
+// NewDB opens a connection to the database using the named driver
+func NewDB(driver, dsn string) (*DB, error) {
+	switch driver {
+	case "mysql":
+		return NewMySQLDB(dsn)
+	case "sqlite":
+		return NewSQLiteDB(dsn)
+	}
+	return nil, fmt.Errorf("Unknown database driver %q, expected mysql or sqlite", driver)
+}
+
+// describeDSN returns the dsn without its password, so the logs show which
+// database is used
+func describeDSN(driver, dsn string) string {
+	switch driver {
+	case "mysql":
+		config, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return "(invalid)"
+		}
+		config.Passwd = ""
+		return config.FormatDSN()
+	case "sqlite":
+		if dsn == ":memory:" {
+			return dsn
+		}
+		path, err := filepath.Abs(dsn)
+		if err != nil {
+			return dsn
+		}
+		return path
+	}
+	return ""
+}
+
+// queryNames returns the names returned by a query selecting one column
+func queryNames(conn *sql.Conn, query string, args ...interface{}) (map[string]bool, error) {
+	rows, err := conn.QueryContext(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := map[string]bool{}
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names[name] = true
+	}
+	return names, rows.Err()
+}
+
+// replaceStatement builds a "<verb> INTO table (columns) VALUES (?, ...)"
+// statement
+func replaceStatement(verb, table string, columns []string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	return fmt.Sprintf("%s INTO %s (%s) VALUES (%s)",
+		verb,
+		table,
+		strings.Join(columns, ", "),
+		placeholders,
+	)
+}
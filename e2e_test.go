@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	csrfTokenPattern = regexp.MustCompile(`name="csrf_token" value="([^"]*)"`)
+	imageLinkPattern = regexp.MustCompile(`href="/image/(img_[^"]+)"`)
+)
+
+// newTestApp returns the full application with in-memory stores and a
+// temporary blob directory, unless other stores are given. Downloads from
+// loopback addresses are allowed, so images can be fetched from httptest
+// servers.
+func newTestApp(t *testing.T, stores Stores) *App {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.HashCost = bcrypt.MinCost
+	config.Fetcher.AllowPrivateNetworks = true
+
+	if stores.Users == nil {
+		stores.Users = NewMemoryUserStore()
+	}
+	if stores.Sessions == nil {
+		stores.Sessions = NewMemorySessionStore()
+	}
+	if stores.Images == nil {
+		stores.Images = NewMemoryImageStore()
+	}
+	if stores.Blobs == nil {
+		blobs, err := NewFileBlobStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores.Blobs = blobs
+	}
+
+	app, err := NewApp(config, &stores, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+// newTestServer starts the application of newTestApp
+func newTestServer(t *testing.T) (*httptest.Server, *App) {
+	t.Helper()
+
+	app := newTestApp(t, Stores{})
+	server := httptest.NewServer(app)
+	t.Cleanup(server.Close)
+	return server, app
+}
+
+// testPNG returns a small valid PNG image
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	err := png.Encode(&buffer, image.NewRGBA(image.Rect(0, 0, 4, 3)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// browser is a client with its own cookies, which remembers the CSRF token
+// of the last page it loaded like a browser's forms do
+type browser struct {
+	t         *testing.T
+	server    *httptest.Server
+	client    *http.Client
+	csrfToken string
+}
+
+func newBrowser(t *testing.T, server *httptest.Server) *browser {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &browser{
+		t:      t,
+		server: server,
+		client: &http.Client{Jar: jar},
+	}
+}
+
+// do sends the request, follows redirects and returns the final response
+// with its body
+func (b *browser) do(request *http.Request) (*http.Response, string) {
+	b.t.Helper()
+
+	response, err := b.client.Do(request)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	if match := csrfTokenPattern.FindStringSubmatch(string(body)); match != nil {
+		b.csrfToken = match[1]
+	}
+	return response, string(body)
+}
+
+func (b *browser) get(path string) (*http.Response, string) {
+	b.t.Helper()
+
+	request, err := http.NewRequest("GET", b.server.URL+path, nil)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	return b.do(request)
+}
+
+// post submits a form with the CSRF token of the last page
+func (b *browser) post(path string, form url.Values) (*http.Response, string) {
+	b.t.Helper()
+
+	if form.Get(csrfFieldName) == "" {
+		form.Set(csrfFieldName, b.csrfToken)
+	}
+	request, err := http.NewRequest("POST", b.server.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return b.do(request)
+}
+
+// upload submits the new image form with a file, which is left out if data
+// is nil
+func (b *browser) upload(description string, data []byte) (*http.Response, string) {
+	b.t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField(csrfFieldName, b.csrfToken)
+	writer.WriteField("description", description)
+	if data != nil {
+		part, err := writer.CreateFormFile("file", "gopher.png")
+		if err != nil {
+			b.t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	writer.Close()
+
+	request, err := http.NewRequest("POST", b.server.URL+"/images/new", &body)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	return b.do(request)
+}
+
+// expectPage fails unless the response is a page at the path containing
+// all the given texts, which are HTML escaped like the templates do. Markup
+// has to be checked on the body directly.
+func expectPage(t *testing.T, response *http.Response, body, path string, texts ...string) {
+	t.Helper()
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("%s: status = %d, want %d", response.Request.URL, response.StatusCode, http.StatusOK)
+	}
+	if response.Request.URL.Path != path {
+		t.Errorf("ended up on %s, want %s", response.Request.URL, path)
+	}
+	for _, text := range texts {
+		if !strings.Contains(body, html.EscapeString(text)) {
+			t.Errorf("%s doesn't contain %q", response.Request.URL, text)
+		}
+	}
+}
+
+func TestRegisterUploadAndSignOut(t *testing.T) {
+	server, app := newTestServer(t)
+	png := testPNG(t)
+
+	// The images the user uploads from a url
+	imageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/gopher.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(png)
+	}))
+	defer imageServer.Close()
+
+	gopher := newBrowser(t, server)
+
+	// Visitors have to sign in before adding images
+	response, body := gopher.get("/images/new")
+	expectPage(t, response, body, "/login", "Sign in")
+	if next := response.Request.URL.Query().Get("next"); next != "/images/new" {
+		t.Errorf("login next = %q, want /images/new", next)
+	}
+
+	t.Run("register", func(t *testing.T) {
+		response, body := gopher.get("/register?next=/images/new")
+		expectPage(t, response, body, "/register", "Sign Up")
+		if gopher.csrfToken == "" {
+			t.Fatal("the register form has no CSRF token")
+		}
+
+		// Forms without the session's token are rejected
+		response, _ = gopher.post("/register", url.Values{
+			"csrf_token": {"forged"},
+			"username":   {"gopher"},
+			"email":      {"gopher@example.com"},
+			"password":   {"secret password"},
+		})
+		if response.StatusCode != http.StatusForbidden {
+			t.Errorf("register with a forged CSRF token: status = %d, want %d", response.StatusCode, http.StatusForbidden)
+		}
+
+		// Validation errors show the form again with the entered values
+		invalid := []struct {
+			form url.Values
+			err  error
+		}{
+			{url.Values{"username": {""}, "email": {"gopher@example.com"}, "password": {"secret password"}}, errNoUsername},
+			{url.Values{"username": {"gopher"}, "email": {""}, "password": {"secret password"}}, errNoEmail},
+			{url.Values{"username": {"gopher"}, "email": {"gopher@example.com"}, "password": {"short"}}, errPasswordTooShort},
+		}
+		for _, test := range invalid {
+			test.form.Set("next", "/images/new")
+			response, body := gopher.post("/register", test.form)
+			expectPage(t, response, body, "/register", test.err.Error())
+			if !strings.Contains(body, `name="next" value="/images/new"`) {
+				t.Errorf("the form lost the next page after %q", test.err)
+			}
+			if username := test.form.Get("username"); username != "" && !strings.Contains(body, `value="`+username+`"`) {
+				t.Errorf("the form lost the username after %q", test.err)
+			}
+		}
+
+		// Signed in right away and sent on to the page asked for
+		response, body = gopher.post("/register", url.Values{
+			"username": {"gopher"},
+			"email":    {"gopher@example.com"},
+			"password": {"secret password"},
+			"next":     {"/images/new"},
+		})
+		expectPage(t, response, body, "/images/new", "User created", "Add An Image", "Sign out")
+
+		// Somebody else can't take the same name
+		other := newBrowser(t, server)
+		other.get("/register")
+		response, body = other.post("/register", url.Values{
+			"username": {"Gopher"},
+			"email":    {"other@example.com"},
+			"password": {"secret password"},
+		})
+		expectPage(t, response, body, "/register", errUsernameExists.Error())
+	})
+
+	t.Run("upload from file", func(t *testing.T) {
+		gopher.get("/images/new")
+
+		response, body := gopher.upload("Nothing", nil)
+		expectPage(t, response, body, "/images/new", errNoImage.Error())
+
+		response, body = gopher.upload("Not an image", []byte("just some text"))
+		expectPage(t, response, body, "/images/new", errInvalidImageType.Error(), "Not an image")
+
+		response, body = gopher.upload("Uploaded gopher", png)
+		expectPage(t, response, body, "/", "Image Uploaded Successfully", "Uploaded gopher")
+	})
+
+	t.Run("upload from url", func(t *testing.T) {
+		gopher.get("/images/new")
+
+		response, body := gopher.post("/images/new", url.Values{
+			"url":         {imageServer.URL + "/missing.png"},
+			"description": {"Missing gopher"},
+		})
+		expectPage(t, response, body, "/images/new", errImageURLInvalid.Error(), "Missing gopher")
+
+		response, body = gopher.post("/images/new", url.Values{
+			"url":         {imageServer.URL + "/gopher.png"},
+			"description": {"Downloaded gopher"},
+		})
+		expectPage(t, response, body, "/", "Image Uploaded Successfully", "Downloaded gopher", "Uploaded gopher")
+	})
+
+	t.Run("view", func(t *testing.T) {
+		response, body := gopher.get("/")
+		expectPage(t, response, body, "/", "Latest Images")
+
+		links := imageLinkPattern.FindAllStringSubmatch(body, -1)
+		if len(links) != 2 {
+			t.Fatalf("the home page links %d images, want 2", len(links))
+		}
+		for _, link := range links {
+			image, err := app.Images.Find(link[1])
+			if err != nil || image == nil {
+				t.Fatalf("Find(%s) = %v, %v", link[1], image, err)
+			}
+
+			// Visitors see the images as well
+			visitor := newBrowser(t, server)
+			response, body := visitor.get(image.ShowRoute())
+			expectPage(t, response, body, image.ShowRoute(), image.Description, "gopher", image.StaticRoute())
+
+			response, body = visitor.get(image.StaticRoute())
+			expectPage(t, response, body, image.StaticRoute())
+			if contentType := response.Header.Get("Content-Type"); contentType != "image/png" {
+				t.Errorf("%s: Content-Type = %q, want image/png", image.StaticRoute(), contentType)
+			}
+			if body != string(png) {
+				t.Errorf("%s doesn't serve the uploaded image", image.StaticRoute())
+			}
+		}
+
+		response, _ = gopher.get("/image/img_missing")
+		if response.StatusCode != http.StatusNotFound {
+			t.Errorf("missing image: status = %d, want %d", response.StatusCode, http.StatusNotFound)
+		}
+	})
+
+	t.Run("sign out", func(t *testing.T) {
+		gopher.get("/")
+		response, body := gopher.post("/signout", url.Values{})
+		expectPage(t, response, body, "/signout", "Signed out")
+
+		response, body = gopher.get("/images/new")
+		expectPage(t, response, body, "/login", "Sign in")
+	})
+
+	t.Run("sign in", func(t *testing.T) {
+		gopher.get("/login?next=/images/new")
+
+		response, body := gopher.post("/login", url.Values{
+			"username": {"gopher"},
+			"password": {"wrong password"},
+			"next":     {"/images/new"},
+		})
+		expectPage(t, response, body, "/login", errCredentialsIncorrect.Error())
+		if !strings.Contains(body, `name="username" value="gopher"`) {
+			t.Error("the form lost the username")
+		}
+
+		response, body = gopher.post("/login", url.Values{
+			"username": {"gopher"},
+			"password": {"secret password"},
+			"next":     {"/images/new"},
+		})
+		expectPage(t, response, body, "/images/new", "Signed in", "Add An Image")
+	})
+}
@@ -2,27 +2,44 @@ package main
 
 import "errors"
 
-// ValidationError is a subtype for user input error messages
-type ValidationError error
+// ValidationError is an error in the user's input, its message is shown to
+// the user
+type ValidationError struct {
+	message string
+}
+
+// NewValidationError returns a ValidationError with the given message
+func NewValidationError(message string) ValidationError {
+	return ValidationError{message: message}
+}
+
+func (err ValidationError) Error() string {
+	return err.message
+}
 
 var (
-	errNoUsername           = ValidationError(errors.New("You must supply a user name"))
-	errNoEmail              = ValidationError(errors.New("You must supply an email address"))
-	errNoPassword           = ValidationError(errors.New("You must supply a password"))
-	errPasswordTooShort     = ValidationError(errors.New("Your password is too short"))
-	errUsernameExists       = ValidationError(errors.New("That username is already taken"))
-	errEmailExists          = ValidationError(errors.New("That email address has already registered an account"))
-	errCredentialsIncorrect = ValidationError(errors.New("We couldn't find a user with the supplied username and password combination"))
-	errPasswordIncorrect    = ValidationError(errors.New("Password did not match"))
+	errNoUsername           = NewValidationError("You must supply a user name")
+	errNoEmail              = NewValidationError("You must supply an email address")
+	errNoPassword           = NewValidationError("You must supply a password")
+	errPasswordTooShort     = NewValidationError("Your password is too short")
+	errUsernameExists       = NewValidationError("That username is already taken")
+	errEmailExists          = NewValidationError("That email address has already registered an account")
+	errCredentialsIncorrect = NewValidationError("We couldn't find a user with the supplied username and password combination")
+	errPasswordIncorrect    = NewValidationError("Password did not match")
 
 	// Image Manipulation Errors
-	errInvalidImageType = ValidationError(errors.New("Please upload only jpeg, gif or png images"))
-	errNoImage          = ValidationError(errors.New("Please select an image to upload"))
-	errImageURLInvalid  = ValidationError(errors.New("Couldn't download image from the URL you provided"))
+	errInvalidImageType        = NewValidationError("Please upload only jpeg, gif or png images")
+	errImageInvalid            = NewValidationError("The file you provided isn't a valid image")
+	errImageDimensionsTooLarge = NewValidationError("The image's dimensions are too large")
+	errNoImage                 = NewValidationError("Please select an image to upload")
+	errImageURLInvalid         = NewValidationError("Couldn't download image from the URL you provided")
+	errImageURLForbidden       = NewValidationError("Downloading images from the URL you provided isn't allowed")
+	errImageURLTimeout         = NewValidationError("Downloading the image from the URL you provided took too long")
+	errImageTooBig             = NewValidationError("The image you provided is too big")
 )
 
 // IsValidationError returns true if the given error is a user input validation error
 func IsValidationError(err error) bool {
-	_, ok := err.(ValidationError)
-	return ok
+	var validationErr ValidationError
+	return errors.As(err, &validationErr)
 }
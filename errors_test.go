@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestIsValidationError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"plain error", errors.New("connection refused"), false},
+		{"validation error", errNoUsername, true},
+		{"wrapped validation error", fmt.Errorf("saving user: %w", errUsernameExists), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsValidationError(test.err); got != test.want {
+				t.Errorf("IsValidationError(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
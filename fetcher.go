@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FetcherConfig holds the limits applied when downloading remote images
+type FetcherConfig struct {
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	Timeout        time.Duration `yaml:"timeout"`
+	MaxBytes       int64         `yaml:"max_bytes"`
+	MaxRedirects   int           `yaml:"max_redirects"`
+	// AllowedHosts restricts downloads to these hosts and their subdomains
+	// if it isn't empty
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	// DeniedHosts are never downloaded from, including their subdomains
+	DeniedHosts []string `yaml:"denied_hosts"`
+	// AllowPrivateNetworks permits loopback, private and link-local
+	// addresses, which should only ever be enabled for testing
+	AllowPrivateNetworks bool `yaml:"allow_private_networks"`
+}
+
+// ImageFetcher downloads remote images while refusing to connect to internal
+// network addresses
+type ImageFetcher struct {
+	config FetcherConfig
+	client *http.Client
+	logger *Logger
+}
+
+// Address ranges which must never be reached from user supplied urls
+var forbiddenNetworks = parseCIDRs(
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, including cloud metadata services
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved and broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b::/96",   // IPv4/IPv6 translation
+	"2001::/32",      // Teredo tunneling, embeds an IPv4 address
+	"2002::/16",      // 6to4, embeds an IPv4 address
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+)
+
+var (
+	errFetchForbidden = errors.New("fetcher: address is not allowed")
+	errFetchTooLarge  = errors.New("fetcher: response exceeds the size limit")
+)
+
+// NewImageFetcher returns an ImageFetcher enforcing the given limits
+func NewImageFetcher(config FetcherConfig, logger *Logger) *ImageFetcher {
+	fetcher := &ImageFetcher{
+		config: config,
+		logger: logger,
+	}
+
+	// The dialer checks the resolved address of every connection, which
+	// includes connections made while following redirects
+	dialer := &net.Dialer{
+		Timeout: config.ConnectTimeout,
+		Control: fetcher.checkAddress,
+	}
+
+	fetcher.client = &http.Client{
+		Timeout: config.Timeout,
+		Transport: &http.Transport{
+			// Never use a proxy, it would hide the real address from the dialer
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   config.ConnectTimeout,
+			ResponseHeaderTimeout: config.Timeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: fetcher.checkRedirect,
+	}
+
+	return fetcher
+}
+
+// Fetch downloads the given url and returns the response body. Errors are
+// returned as validation errors, as the url is supplied by the user.
+func (fetcher *ImageFetcher) Fetch(rawURL string) ([]byte, error) {
+	start := time.Now()
+	data, err := fetcher.fetch(rawURL)
+	if err == errImageURLForbidden {
+		fetcher.logger.Warn("image download refused", "url", rawURL)
+		return nil, err
+	}
+	if err != nil {
+		fetcher.logger.Info("image download failed", "url", rawURL, "error", err)
+		return nil, err
+	}
+
+	fetcher.logger.Debug("image downloaded", "url", rawURL, "bytes", len(data), "duration", time.Since(start))
+	return data, nil
+}
+
+// fetch does the work of Fetch
+func (fetcher *ImageFetcher) fetch(rawURL string) ([]byte, error) {
+	requestURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errImageURLInvalid
+	}
+	if err := fetcher.checkURL(requestURL); err != nil {
+		return nil, fetchError(err)
+	}
+
+	response, err := fetcher.client.Get(requestURL.String())
+	if err != nil {
+		return nil, fetchError(err)
+	}
+	defer response.Body.Close()
+
+	// Make sure we got a response
+	if response.StatusCode != http.StatusOK {
+		return nil, errImageURLInvalid
+	}
+
+	if response.ContentLength > fetcher.config.MaxBytes {
+		return nil, errImageTooBig
+	}
+
+	// The content length may be missing or wrong, so enforce the limit on
+	// the bytes actually read
+	data, err := ioutil.ReadAll(&limitedReader{
+		body:  response.Body,
+		limit: fetcher.config.MaxBytes,
+	})
+	if err != nil {
+		return nil, fetchError(err)
+	}
+	return data, nil
+}
+
+// checkURL makes sure the url uses http(s) and its host is allowed
+func (fetcher *ImageFetcher) checkURL(requestURL *url.URL) error {
+	if requestURL.Scheme != "http" && requestURL.Scheme != "https" {
+		return errFetchForbidden
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(requestURL.Hostname(), "."))
+	if host == "" {
+		return errFetchForbidden
+	}
+
+	for _, denied := range fetcher.config.DeniedHosts {
+		if matchesHost(host, denied) {
+			return errFetchForbidden
+		}
+	}
+
+	if len(fetcher.config.AllowedHosts) == 0 {
+		return nil
+	}
+	for _, allowed := range fetcher.config.AllowedHosts {
+		if matchesHost(host, allowed) {
+			return nil
+		}
+	}
+	return errFetchForbidden
+}
+
+// checkRedirect limits the number of redirects and checks every redirect
+// target against the host lists
+func (fetcher *ImageFetcher) checkRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) > fetcher.config.MaxRedirects {
+		return errors.New("fetcher: too many redirects")
+	}
+	return fetcher.checkURL(request.URL)
+}
+
+// checkAddress is called by the dialer after the host name was resolved and
+// refuses to connect to internal network addresses
+func (fetcher *ImageFetcher) checkAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errFetchForbidden
+	}
+
+	if fetcher.config.AllowPrivateNetworks {
+		return nil
+	}
+
+	for _, network := range forbiddenNetworks {
+		if network.Contains(ip) {
+			return errFetchForbidden
+		}
+	}
+	return nil
+}
+
+// fetchError translates errors of a download into validation errors
+func fetchError(err error) error {
+	switch {
+	case errors.Is(err, errFetchForbidden):
+		return errImageURLForbidden
+	case errors.Is(err, errFetchTooLarge):
+		return errImageTooBig
+	case errors.Is(err, context.DeadlineExceeded):
+		return errImageURLTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errImageURLTimeout
+	}
+	return errImageURLInvalid
+}
+
+// matchesHost returns true if the host equals the pattern or is a subdomain
+// of it
+func matchesHost(host, pattern string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// limitedReader reads from the response body and fails once more than limit
+// bytes have been read
+type limitedReader struct {
+	body  io.Reader
+	limit int64
+	read  int64
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.read += int64(n)
+	if r.read > r.limit {
+		return n, errFetchTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testFetcherConfig returns the default limits, allowing the loopback
+// addresses of httptest servers
+func testFetcherConfig() FetcherConfig {
+	config := DefaultConfig().Fetcher
+	config.AllowPrivateNetworks = true
+	return config
+}
+
+// routeHost makes the fetcher connect to the server for the given host name
+// without checking the server's address, so the host stands in for a site
+// on the internet. Every other address still goes through the checks.
+func routeHost(fetcher *ImageFetcher, host string, server *httptest.Server) {
+	transport := fetcher.client.Transport.(*http.Transport)
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == host+":80" {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		}
+		return dial(ctx, network, address)
+	}
+}
+
+func TestFetcherRefusesPrivateAddresses(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte("secret"))
+	}))
+	defer server.Close()
+
+	config := testFetcherConfig()
+	config.AllowPrivateNetworks = false
+	fetcher := NewImageFetcher(config, nil)
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	for _, rawURL := range []string{server.URL, "http://localhost:" + port + "/"} {
+		if _, err := fetcher.Fetch(rawURL); err != errImageURLForbidden {
+			t.Errorf("Fetch(%s) = %v, want %v", rawURL, err, errImageURLForbidden)
+		}
+	}
+	if hits != 0 {
+		t.Errorf("the loopback server was reached %d times", hits)
+	}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"2002:7f00:1::1", false},
+		{"2002:a9fe:a9fe::1", false},
+		{"2001:0:4136:e378:8000:63bf:3fff:fdd2", false},
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+		{"2001:4860:4860::8888", true},
+	}
+	for _, test := range tests {
+		err := fetcher.checkAddress("tcp", net.JoinHostPort(test.ip, "80"), nil)
+		if (err == nil) != test.allowed {
+			t.Errorf("checkAddress(%s) = %v, want allowed %v", test.ip, err, test.allowed)
+		}
+	}
+}
+
+func TestFetcherRefusesRedirectsToPrivateAddresses(t *testing.T) {
+	var hits int32
+	private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte("secret"))
+	}))
+	defer private.Close()
+
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, private.URL+"/latest/meta-data/", http.StatusFound)
+	}))
+	defer public.Close()
+
+	config := testFetcherConfig()
+	config.AllowPrivateNetworks = false
+	fetcher := NewImageFetcher(config, nil)
+	routeHost(fetcher, "images.example.com", public)
+
+	_, err := fetcher.Fetch("http://images.example.com/gopher.png")
+	if err != errImageURLForbidden {
+		t.Errorf("Fetch = %v, want %v", err, errImageURLForbidden)
+	}
+	if hits != 0 {
+		t.Errorf("the redirect target was reached %d times", hits)
+	}
+}
+
+func TestFetcherRedirectLimit(t *testing.T) {
+	// /redirect/3 redirects to /redirect/2 and so on until /redirect/0
+	// serves the image
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/redirect/"))
+		if n == 0 {
+			w.Write([]byte("image"))
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/redirect/%d", n-1), http.StatusFound)
+	}))
+	defer server.Close()
+
+	config := testFetcherConfig()
+	config.MaxRedirects = 2
+	fetcher := NewImageFetcher(config, nil)
+
+	data, err := fetcher.Fetch(server.URL + "/redirect/2")
+	if err != nil || string(data) != "image" {
+		t.Errorf("Fetch with %d redirects = %q, %v", config.MaxRedirects, data, err)
+	}
+
+	_, err = fetcher.Fetch(server.URL + "/redirect/3")
+	if err != errImageURLInvalid {
+		t.Errorf("Fetch with %d redirects = %v, want %v", config.MaxRedirects+1, err, errImageURLInvalid)
+	}
+}
+
+func TestFetcherMaxBytes(t *testing.T) {
+	const maxBytes = 100
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		data := bytes.Repeat([]byte("x"), size)
+
+		// Flushing before writing the body leaves out the Content-Length
+		if r.URL.Query().Get("chunked") != "" {
+			w.(http.Flusher).Flush()
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	config := testFetcherConfig()
+	config.MaxBytes = maxBytes
+	fetcher := NewImageFetcher(config, nil)
+
+	tests := []struct {
+		query string
+		err   error
+	}{
+		{"size=100", nil},
+		{"size=101", errImageTooBig},
+		{"size=100&chunked=1", nil},
+		{"size=101&chunked=1", errImageTooBig},
+		{"size=100000&chunked=1", errImageTooBig},
+	}
+	for _, test := range tests {
+		data, err := fetcher.Fetch(server.URL + "/?" + test.query)
+		if err != test.err {
+			t.Errorf("Fetch(%s) = %v, want %v", test.query, err, test.err)
+		}
+		if err == nil && len(data) != maxBytes {
+			t.Errorf("Fetch(%s) returned %d bytes", test.query, len(data))
+		}
+	}
+}
+
+func TestFetcherTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The body is started, but never finished
+		if r.URL.Path == "/slow-body" {
+			w.Header().Set("Content-Length", "10")
+			w.Write([]byte("x"))
+			w.(http.Flusher).Flush()
+		}
+
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	config := testFetcherConfig()
+	config.Timeout = 100 * time.Millisecond
+	fetcher := NewImageFetcher(config, nil)
+
+	for _, path := range []string{"/slow-headers", "/slow-body"} {
+		start := time.Now()
+		_, err := fetcher.Fetch(server.URL + path)
+		if err != errImageURLTimeout {
+			t.Errorf("Fetch(%s) = %v, want %v", path, err, errImageURLTimeout)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Fetch(%s) took %s with a timeout of %s", path, elapsed, config.Timeout)
+		}
+	}
+}
+
+func TestFetcherHostLists(t *testing.T) {
+	config := testFetcherConfig()
+	config.AllowedHosts = []string{"images.example.com", "cdn.example.org."}
+	config.DeniedHosts = []string{"private.images.example.com"}
+	fetcher := NewImageFetcher(config, nil)
+
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://images.example.com/gopher.png", true},
+		{"https://IMAGES.example.com./gopher.png", true},
+		{"https://eu.images.example.com/gopher.png", true},
+		{"http://cdn.example.org:8080/gopher.png", true},
+		{"https://private.images.example.com/gopher.png", false},
+		{"https://a.private.images.example.com/gopher.png", false},
+		{"https://evilimages.example.com/gopher.png", false},
+		{"https://example.com/gopher.png", false},
+		{"https://images.example.com.evil.net/gopher.png", false},
+		{"ftp://images.example.com/gopher.png", false},
+		{"file:///etc/passwd", false},
+		{"http:///gopher.png", false},
+	}
+	for _, test := range tests {
+		requestURL, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fetcher.checkURL(requestURL)
+		if (err == nil) != test.allowed {
+			t.Errorf("checkURL(%s) = %v, want allowed %v", test.url, err, test.allowed)
+		}
+	}
+
+	t.Run("denied hosts without allowed hosts", func(t *testing.T) {
+		config := testFetcherConfig()
+		config.DeniedHosts = []string{"example.com"}
+		fetcher := NewImageFetcher(config, nil)
+
+		for rawURL, allowed := range map[string]bool{
+			"https://example.com/a.png":     false,
+			"https://www.example.com/a.png": false,
+			"https://example.org/a.png":     true,
+		} {
+			requestURL, _ := url.Parse(rawURL)
+			if err := fetcher.checkURL(requestURL); (err == nil) != allowed {
+				t.Errorf("checkURL(%s) = %v, want allowed %v", rawURL, err, allowed)
+			}
+		}
+	})
+
+	t.Run("redirects", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/image" {
+				w.Write([]byte("image"))
+				return
+			}
+			http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+		}))
+		defer server.Close()
+
+		_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+		config := testFetcherConfig()
+		config.AllowedHosts = []string{"localhost"}
+		fetcher := NewImageFetcher(config, nil)
+
+		allowedURL := "http://localhost:" + port + "/image"
+		deniedURL := "http://127.0.0.1:" + port + "/image"
+
+		if data, err := fetcher.Fetch(allowedURL); err != nil || string(data) != "image" {
+			t.Errorf("Fetch(%s) = %q, %v", allowedURL, data, err)
+		}
+		if _, err := fetcher.Fetch(deniedURL); err != errImageURLForbidden {
+			t.Errorf("Fetch(%s) = %v, want %v", deniedURL, err, errImageURLForbidden)
+		}
+
+		redirectURL := "http://localhost:" + port + "/redirect?to=" + url.QueryEscape(deniedURL)
+		if _, err := fetcher.Fetch(redirectURL); err != errImageURLForbidden {
+			t.Errorf("Fetch(redirect to a host not allowed) = %v, want %v", err, errImageURLForbidden)
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// These tests are meant to be run with the race detector, go test -race
+
+const (
+	concurrentWorkers = 8
+	concurrentRounds  = 20
+)
+
+func TestFileUserStoreConcurrentUse(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "users.yaml")
+	store, err := NewFileUserStore(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Save(User{ID: "usr_taken", Username: "taken", Email: "taken@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < concurrentWorkers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for round := 0; round < concurrentRounds; round++ {
+				name := fmt.Sprintf("user%d_%d", worker, round)
+				err := store.Save(User{ID: name, Username: name, Email: name + "@example.com"})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				// Everybody tries to take a name which is taken
+				err = store.Save(User{ID: name + "_dup", Username: "TAKEN", Email: name + "_dup@example.com"})
+				if err != errUsernameExists {
+					t.Errorf("Save(taken username) = %v, want %v", err, errUsernameExists)
+				}
+
+				user, err := store.FindByUsername(strings.ToUpper(name))
+				if err != nil || user == nil || user.ID != name {
+					t.Errorf("FindByUsername(%s) = %v, %v", name, user, err)
+				}
+				store.FindByEmail(name + "@example.com")
+				store.Find(name)
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	reloaded, err := NewFileUserStore(filename, nil)
+	if err != nil {
+		t.Fatalf("reloading the store: %s", err)
+	}
+	for worker := 0; worker < concurrentWorkers; worker++ {
+		for round := 0; round < concurrentRounds; round++ {
+			name := fmt.Sprintf("user%d_%d", worker, round)
+			if _, ok := reloaded.Users[name]; !ok {
+				t.Errorf("user %s is missing after reloading", name)
+			}
+		}
+	}
+
+	if len(reloaded.Users) != concurrentWorkers*concurrentRounds+1 {
+		t.Errorf("reloaded %d users, want %d", len(reloaded.Users), concurrentWorkers*concurrentRounds+1)
+	}
+
+	assertNoTempFiles(t, dir)
+}
+
+func TestFileSessionStoreConcurrentUse(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "sessions.yaml")
+	store, err := NewFileSessionStore(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Now().Add(time.Hour)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < concurrentWorkers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			userID := fmt.Sprintf("usr_%d", worker)
+			for round := 0; round < concurrentRounds; round++ {
+				session := &Session{
+					ID:       fmt.Sprintf("sess_%d_%d", worker, round),
+					UserID:   userID,
+					Expiry:   expiry,
+					LastSeen: time.Now(),
+				}
+				err := store.Save(session)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				found, err := store.Find(session.ID)
+				if err != nil || found == nil {
+					t.Errorf("Find(%s) = %v, %v", session.ID, found, err)
+				}
+				store.FindAllByUser(userID)
+				store.CountActive(time.Now())
+
+				// Every other session is deleted again
+				if round%2 == 1 {
+					err = store.Delete(session)
+					if err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	reloaded, err := NewFileSessionStore(filename, nil)
+	if err != nil {
+		t.Fatalf("reloading the store: %s", err)
+	}
+	if len(reloaded.Sessions) != concurrentWorkers*concurrentRounds/2 {
+		t.Errorf("reloaded %d sessions, want %d", len(reloaded.Sessions), concurrentWorkers*concurrentRounds/2)
+	}
+	for id := range reloaded.Sessions {
+		var worker, round int
+		fmt.Sscanf(id, "sess_%d_%d", &worker, &round)
+		if round%2 == 1 {
+			t.Errorf("deleted session %s is back after reloading", id)
+		}
+	}
+
+	assertNoTempFiles(t, dir)
+}
+
+// assertNoTempFiles fails if writeFileAtomic left temporary files behind
+func assertNoTempFiles(t *testing.T, dir string) {
+	t.Helper()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), ".tmp-") {
+			t.Errorf("temporary file %s was left behind", entry.Name())
+		}
+	}
+}
@@ -1,40 +1,42 @@
 package main
 
 import (
+	"io"
 	"net/http"
+	"path/filepath"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 // HandleImageNew handles the new image GET requests
-func HandleImageNew(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+func (app *App) HandleImageNew(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	// display new image form
-	RenderTemplate(w, r, "images/new", nil)
+	app.RenderTemplate(w, r, "images/new", nil)
 
 }
 
 // HandleImageCreate is the new image POST handler and reads an image from url or file
-func HandleImageCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (app *App) HandleImageCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	if r.FormValue("url") != "" {
-		HandleImageCreateFromURL(w, r)
+		app.HandleImageCreateFromURL(w, r)
 		return
 	}
 
-	HandleImageCreateFromFile(w, r)
+	app.HandleImageCreateFromFile(w, r)
 }
 
 // HandleImageCreateFromURL downloads an image from a given url
-func HandleImageCreateFromURL(w http.ResponseWriter, r *http.Request) {
+func (app *App) HandleImageCreateFromURL(w http.ResponseWriter, r *http.Request) {
 	user := RequestUser(r)
 
 	image := NewImage(user)
 	image.Description = r.FormValue("description")
 
-	err := image.CreateFromURL(r.FormValue("url"))
+	err := app.CreateImageFromURL(image, r.FormValue("url"))
 
 	if err != nil {
 		if IsValidationError(err) {
-			RenderTemplate(w, r, "images/new", map[string]interface{}{
+			app.RenderTemplate(w, r, "images/new", map[string]interface{}{
 				"Error":    err,
 				"ImageURL": r.FormValue("url"),
 				"Image":    image,
@@ -44,11 +46,11 @@ func HandleImageCreateFromURL(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	http.Redirect(w, r, "/?flash=Image+Uploaded+Successfully", http.StatusFound)
+	Redirect(w, r, "/", "Image Uploaded Successfully")
 }
 
 // HandleImageCreateFromFile uploads an image from a given file
-func HandleImageCreateFromFile(w http.ResponseWriter, r *http.Request) {
+func (app *App) HandleImageCreateFromFile(w http.ResponseWriter, r *http.Request) {
 
 	user := RequestUser(r)
 	image := NewImage(user)
@@ -56,9 +58,18 @@ func HandleImageCreateFromFile(w http.ResponseWriter, r *http.Request) {
 
 	file, headers, err := r.FormFile("file")
 
+	// The request body exceeded the limit before the file was complete
+	if isRequestTooLarge(err) {
+		app.RenderTemplate(w, r, "images/new", map[string]interface{}{
+			"Error": errImageTooBig,
+			"Image": image,
+		})
+		return
+	}
+
 	// No file was uploaded
 	if file == nil {
-		RenderTemplate(w, r, "images/new", map[string]interface{}{
+		app.RenderTemplate(w, r, "images/new", map[string]interface{}{
 			"Error": errNoImage,
 			"Image": image,
 		})
@@ -71,14 +82,95 @@ func HandleImageCreateFromFile(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	err = image.CreateFromFile(file, headers)
+	err = app.CreateImageFromFile(image, file, headers)
 	if err != nil {
-		RenderTemplate(w, r, "images/new", map[string]interface{}{
-			"Error": err,
-			"Image": image,
-		})
+		if IsValidationError(err) {
+			app.RenderTemplate(w, r, "images/new", map[string]interface{}{
+				"Error": err,
+				"Image": image,
+			})
+			return
+		}
+		panic(err)
+	}
+
+	Redirect(w, r, "/", "Image Uploaded Successfully")
+}
+
+// HandleImageShow is the /image/:imageID GET handler and displays a single image
+// with its details
+func (app *App) HandleImageShow(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	image, err := app.Images.Find(params.ByName("imageID"))
+	if err != nil {
+		panic(err)
+	}
+
+	// No image with that id exists
+	if image == nil {
+		app.NotFound(w, r)
 		return
 	}
 
-	http.Redirect(w, r, "/?flash=Image+Uploaded+Successfully", http.StatusFound)
+	user, err := app.Users.Find(image.UserID)
+	if err != nil {
+		panic(err)
+	}
+
+	app.RenderTemplate(w, r, "images/show", map[string]interface{}{
+		"Image": image,
+		"User":  user,
+	})
+}
+
+// HandleImageFile is the /im/:location GET handler and serves the raw image
+// file or one of its variants including support for conditional and range
+// requests. Variants which haven't been generated fall back to the original.
+func (app *App) HandleImageFile(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	location := params.ByName("location")
+
+	// The location consists of the image id, an optional variant name and
+	// the file extension
+	id, variant := parseImageLocation(location)
+	image, err := app.Images.Find(id)
+	if err != nil {
+		panic(err)
+	}
+	if image == nil || filepath.Ext(image.Location) != filepath.Ext(location) {
+		app.NotFound(w, r)
+		return
+	}
+
+	var file io.ReadSeekCloser
+	if _, exists := image.Variants[variant]; exists {
+		file, err = app.Blobs.Get(image.VariantLocation(variant))
+		if err != nil && err != errBlobNotFound {
+			panic(err)
+		}
+	}
+
+	// Serve the original if no variant was requested or it's missing
+	if file == nil {
+		variant = ""
+		file, err = app.Blobs.Get(image.Location)
+		if err == errBlobNotFound {
+			app.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+	defer file.Close()
+
+	// Images never change once uploaded, so the id is a sufficient ETag
+	etag := image.ID
+	if variant != "" {
+		etag += "_" + variant
+	}
+	w.Header().Set("Content-Type", image.ContentType())
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000")
+
+	// ServeContent takes care of Last-Modified, If-None-Match and Range headers
+	http.ServeContent(w, r, location, image.CreatedAt, file)
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// multipartUpload returns a multipart form body uploading data as the image
+// file, with the CSRF token as form value unless it's empty
+func multipartUpload(t *testing.T, csrfToken string, data []byte) (string, []byte) {
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if csrfToken != "" {
+		writer.WriteField(csrfFieldName, csrfToken)
+	}
+	writer.WriteField("description", "A gopher")
+	part, err := writer.CreateFormFile("file", "gopher.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	writer.Close()
+
+	return writer.FormDataContentType(), body.Bytes()
+}
+
+func TestImageUploadSizeLimit(t *testing.T) {
+	app := newTestApp(t, Stores{})
+	config := app.Config
+	config.UploadMaxBytes = 4096
+
+	user := User{ID: "usr_1", Username: "gopher", Email: "gopher@example.com"}
+	app.Users.Save(user)
+	session := &Session{ID: "sess_1", UserID: user.ID, CSRFToken: "token", LastSeen: time.Now()}
+	app.extendSession(session, time.Now())
+	app.Sessions.Save(session)
+
+	upload := func(contentType string, body io.Reader, csrfHeader bool) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "/images/new", body)
+		request.Header.Set("Content-Type", contentType)
+		request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: app.signSessionID(session.ID)})
+		if csrfHeader {
+			request.Header.Set(csrfHeaderName, session.CSRFToken)
+		}
+		recorder := httptest.NewRecorder()
+		app.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	t.Run("small image", func(t *testing.T) {
+		contentType, body := multipartUpload(t, session.CSRFToken, testPNG(t))
+		response := upload(contentType, bytes.NewReader(body), false)
+		if response.Code != http.StatusFound {
+			t.Errorf("status = %d, want %d", response.Code, http.StatusFound)
+		}
+	})
+
+	t.Run("file over the limit", func(t *testing.T) {
+		data := append(testPNG(t), make([]byte, config.UploadMaxBytes)...)
+		contentType, body := multipartUpload(t, session.CSRFToken, data)
+		response := upload(contentType, bytes.NewReader(body), false)
+		if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), errImageTooBig.Error()) {
+			t.Errorf("status = %d, want the form with %q", response.Code, errImageTooBig)
+		}
+	})
+
+	// The whole body is too large, the form can't be read
+	largeData := make([]byte, config.UploadMaxBytes+maxFormOverhead)
+	contentType, largeBody := multipartUpload(t, session.CSRFToken, largeData)
+
+	t.Run("body over the limit", func(t *testing.T) {
+		response := upload(contentType, bytes.NewReader(largeBody), false)
+		if response.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("status = %d, want %d", response.Code, http.StatusRequestEntityTooLarge)
+		}
+	})
+
+	t.Run("body over the limit without content length", func(t *testing.T) {
+		// A MultiReader hides the length from httptest.NewRequest
+		response := upload(contentType, io.MultiReader(bytes.NewReader(largeBody)), false)
+		if response.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("status = %d, want %d", response.Code, http.StatusRequestEntityTooLarge)
+		}
+
+		contentType, body := multipartUpload(t, "", largeData)
+		response = upload(contentType, io.MultiReader(bytes.NewReader(body)), true)
+		if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), errImageTooBig.Error()) {
+			t.Errorf("status = %d, want the form with %q", response.Code, errImageTooBig)
+		}
+	})
+
+	found, _ := app.Images.FindAll(0, 10)
+	if len(found) != 1 {
+		t.Errorf("%d images were saved, want 1", len(found))
+	}
+}
@@ -6,8 +6,17 @@ import (
 	"github.com/julienschmidt/httprouter"
 )
 
-// HandleHome handles the app's homepage
-func HandleHome(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+// HandleHome handles the app's homepage and displays the latest images
+func (app *App) HandleHome(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	pagination := NewPagination(r, app.Config.PageSize)
+	images, err := app.Images.FindAll(pagination.Offset(), pagination.Limit())
+	if err != nil {
+		panic(err)
+	}
+
 	// display home page
-	RenderTemplate(w, r, "index/home", nil)
+	app.RenderTemplate(w, r, "index/home", map[string]interface{}{
+		"Images":     pagination.Paginate(images),
+		"Pagination": pagination,
+	})
 }
@@ -7,60 +7,127 @@ import (
 )
 
 // HandleSessionNew is the /login GET handler and displays the login form
-func HandleSessionNew(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	next := r.URL.Query().Get("next")
-	RenderTemplate(w, r, "sessions/new", map[string]interface{}{
-		"Next": next,
+func (app *App) HandleSessionNew(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	r = app.EnsureSession(w, r)
+	app.RenderTemplate(w, r, "sessions/new", map[string]interface{}{
+		"Next": SafeRedirectPath(r.URL.Query().Get("next")),
 	})
 }
 
 // HandleSessionCreate is the /login POST handler and checks for the correct password
 // before opening a new session
-func HandleSessionCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (app *App) HandleSessionCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	// extract form values
 	username := r.FormValue("username")
 	password := r.FormValue("password")
-	next := r.FormValue("next")
+	next := SafeRedirectPath(r.FormValue("next"))
+	remember := r.FormValue("remember_me") != ""
 
 	// find user and check for validation errors and password credentials
-	user, err := FindUser(username, password)
+	user, err := app.FindUser(username, password)
 	if err != nil {
 		if IsValidationError(err) {
-			RenderTemplate(w, r, "sessions/new", map[string]interface{}{
-				"Error": err,
-				"User":  user,
-				"Next":  next,
+			app.RenderTemplate(w, r, "sessions/new", map[string]interface{}{
+				"Error":    err,
+				"User":     user,
+				"Next":     next,
+				"Remember": remember,
 			})
 			return
 		}
 		panic(err)
 	}
 
-	// find an existing session for the user or generate a new one
-	session := FindOrCreateSession(w, r)
-	session.UserID = user.ID
-	err = globalSessionStore.Save(session)
-	if err != nil {
-		panic(err)
-	}
-
-	if next == "" {
-		next = "/"
-	}
+	// never reuse the session from before signing in, "remember me" keeps
+	// the user signed in when the browser is closed
+	app.RotateSession(w, r, user, remember)
 
 	// redirect the user to the intended page
-	http.Redirect(w, r, next+"?flash=Signed+in", http.StatusFound)
+	Redirect(w, r, next, "Signed in")
 }
 
 // HandleSessionDestroy is the /signout POST handler and deletes the session from the
-// global store
-func HandleSessionDestroy(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+// session store
+func (app *App) HandleSessionDestroy(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	session := RequestSession(r)
 	if session != nil {
-		err := globalSessionStore.Delete(session)
+		err := app.Sessions.Delete(session)
 		if err != nil {
 			panic(err)
 		}
 	}
-	RenderTemplate(w, r, "sessions/destroy", nil)
+	app.clearSessionCookie(w)
+
+	// The page is rendered for a signed out visitor
+	r = withSession(r, nil, nil)
+	app.RenderTemplate(w, r, "sessions/destroy", nil)
+}
+
+// HandleSessionList is the /account/sessions GET handler and lists the
+// signed in user's sessions with the devices they're used from
+func (app *App) HandleSessionList(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user := RequestUser(r)
+	sessions, err := app.Sessions.FindAllByUser(user.ID)
+	if err != nil {
+		panic(err)
+	}
+
+	// Expired sessions are waiting for the sweeper, they can't be used anymore
+	active := []Session{}
+	for _, session := range sessions {
+		if !session.Expired() {
+			active = append(active, session)
+		}
+	}
+
+	app.RenderTemplate(w, r, "sessions/index", map[string]interface{}{
+		"Sessions":        active,
+		"CurrentPublicID": RequestSession(r).PublicID(),
+	})
+}
+
+// HandleSessionRevoke is the /account/sessions/revoke POST handler and signs
+// out the device of one of the user's sessions
+func (app *App) HandleSessionRevoke(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	// The form refers to the session by its public ID, so only the user's
+	// own sessions can be found
+	sessions, err := app.Sessions.FindAllByUser(RequestUser(r).ID)
+	if err != nil {
+		panic(err)
+	}
+
+	var session *Session
+	for i := range sessions {
+		if sessions[i].PublicID() == r.FormValue("public_id") {
+			session = &sessions[i]
+			break
+		}
+	}
+	if session == nil {
+		app.NotFound(w, r)
+		return
+	}
+
+	err = app.Sessions.Delete(session)
+	if err != nil {
+		panic(err)
+	}
+
+	if session.ID == RequestSession(r).ID {
+		app.clearSessionCookie(w)
+		Redirect(w, r, "/login", "Signed out")
+		return
+	}
+	Redirect(w, r, "/account/sessions", "Device signed out")
+}
+
+// HandleSessionRevokeOthers is the /account/sessions/revoke-others POST
+// handler and signs out every device except the current one
+func (app *App) HandleSessionRevokeOthers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	_, err := app.Sessions.DeleteAllByUser(RequestUser(r).ID, RequestSession(r).ID)
+	if err != nil {
+		panic(err)
+	}
+
+	Redirect(w, r, "/account/sessions", "Signed out everywhere else")
 }
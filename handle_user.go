@@ -7,62 +7,83 @@ import (
 )
 
 // HandleUserNew handles the new user requests
-func HandleUserNew(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	RenderTemplate(w, r, "users/new", nil)
+func (app *App) HandleUserNew(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	r = app.EnsureSession(w, r)
+	app.RenderTemplate(w, r, "users/new", map[string]interface{}{
+		"Next": SafeRedirectPath(r.URL.Query().Get("next")),
+	})
 }
 
 // HandleUserCreate handles the new user requests
-func HandleUserCreate(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	user, err := NewUser(r.FormValue("username"), r.FormValue("email"), r.FormValue("password"))
+func (app *App) HandleUserCreate(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	next := SafeRedirectPath(r.FormValue("next"))
+	user, err := app.NewUser(r.FormValue("username"), r.FormValue("email"), r.FormValue("password"))
 	if err != nil {
 		if IsValidationError(err) {
-			RenderTemplate(w, r, "users/new", map[string]interface{}{
+			app.RenderTemplate(w, r, "users/new", map[string]interface{}{
 				"Error": err.Error(),
 				"User":  user,
+				"Next":  next,
 			})
 			return
 		}
 		panic(err)
 	}
 
-	err = globalUserStore.Save(user)
+	// The store reports usernames or emails taken in the meantime
+	err = app.Users.Save(user)
 	if err != nil {
+		if IsValidationError(err) {
+			app.RenderTemplate(w, r, "users/new", map[string]interface{}{
+				"Error": err.Error(),
+				"User":  user,
+				"Next":  next,
+			})
+			return
+		}
 		panic(err)
 	}
 
-	// Create a new session
-	session := NewSession(w)
-	session.UserID = user.ID
-	err = globalSessionStore.Save(session)
-	if err != nil {
-		panic(err)
-	}
+	// Sign the new user in with a fresh session
+	app.RotateSession(w, r, &user, false)
 
-	http.Redirect(w, r, "/?flash=User+created", http.StatusFound)
+	Redirect(w, r, next, "User created")
 }
 
 // HandleUserEdit is the /account GET handler that show the user's account page
 // for him to edit his personal data
-func HandleUserEdit(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (app *App) HandleUserEdit(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	user := RequestUser(r)
-	RenderTemplate(w, r, "users/edit", map[string]interface{}{
+	app.RenderTemplate(w, r, "users/edit", map[string]interface{}{
 		"User": user,
 	})
 }
 
 // HandleUserUpdate is the /account POST handler and takes the form's data
 // to update the account data
-func HandleUserUpdate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+func (app *App) HandleUserUpdate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	currentUser := RequestUser(r)
 	email := r.FormValue("email")
 	currentPassword := r.FormValue("currentPassword")
 	newPassword := r.FormValue("newPassword")
 
-	user, err := UpdateUser(currentUser, email, currentPassword, newPassword)
+	user, err := app.UpdateUser(currentUser, email, currentPassword, newPassword)
+
+	if err != nil {
+		if IsValidationError(err) {
+			app.RenderTemplate(w, r, "users/edit", map[string]interface{}{
+				"Error": err.Error(),
+				"User":  user,
+			})
+			return
+		}
+		panic(err)
+	}
 
+	err = app.Users.Save(*currentUser)
 	if err != nil {
 		if IsValidationError(err) {
-			RenderTemplate(w, r, "users/edit", map[string]interface{}{
+			app.RenderTemplate(w, r, "users/edit", map[string]interface{}{
 				"Error": err.Error(),
 				"User":  user,
 			})
@@ -71,10 +92,42 @@ func HandleUserUpdate(w http.ResponseWriter, r *http.Request, _ httprouter.Param
 		panic(err)
 	}
 
-	err = globalUserStore.Save(*currentUser)
+	// A new password invalidates the session ID it was changed with and
+	// signs out every other device
+	if newPassword != "" {
+		session, _ := app.RotateSession(w, r, currentUser, RequestSession(r).Persistent)
+		_, err = app.Sessions.DeleteAllByUser(currentUser.ID, session.ID)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	Redirect(w, r, "/account", "User updated")
+}
+
+// HandleUserShow is the /user/:userID GET handler and displays the images
+// uploaded by that user
+func (app *App) HandleUserShow(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	user, err := app.Users.Find(params.ByName("userID"))
+	if err != nil {
+		panic(err)
+	}
+
+	// No user with that id exists
+	if user == nil {
+		app.NotFound(w, r)
+		return
+	}
+
+	pagination := NewPagination(r, app.Config.PageSize)
+	images, err := app.Images.FindAllByUser(user, pagination.Offset(), pagination.Limit())
 	if err != nil {
 		panic(err)
 	}
 
-	http.Redirect(w, r, "/account?flash=User+updated", http.StatusFound)
+	app.RenderTemplate(w, r, "users/show", map[string]interface{}{
+		"User":       user,
+		"Images":     pagination.Paginate(images),
+		"Pagination": pagination,
+	})
 }
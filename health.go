@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// How long the readiness checks may take before the app is reported as not
+// ready
+const readinessTimeout = 5 * time.Second
+
+// HandleHealthz is the /healthz GET handler, which only reports that the
+// process is alive and serving
+func (app *App) HandleHealthz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeHealth(w, http.StatusOK, map[string]interface{}{
+		"status": "ok",
+	})
+}
+
+// HandleReadyz is the /readyz GET handler, which reports whether the
+// database and the data directories are usable, so load balancers only send
+// requests to instances able to serve them
+func (app *App) HandleReadyz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	status := http.StatusOK
+	checks := map[string]string{}
+	for name, check := range app.readinessChecks() {
+		err := check(ctx)
+		if err != nil {
+			app.Logger.Warn("readiness check failed", "check", name, "error", err)
+			checks[name] = err.Error()
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		checks[name] = "ok"
+	}
+
+	result := "ok"
+	if status != http.StatusOK {
+		result = "unavailable"
+	}
+	writeHealth(w, status, map[string]interface{}{
+		"status": result,
+		"checks": checks,
+	})
+}
+
+// readinessChecks returns the checks HandleReadyz runs by their names
+func (app *App) readinessChecks() map[string]func(context.Context) error {
+	checks := map[string]func(context.Context) error{}
+	if app.DB != nil {
+		checks["database"] = app.DB.PingContext
+	}
+
+	for _, dir := range app.dataDirectories() {
+		dir := dir
+		checks["directory:"+dir] = func(context.Context) error {
+			return checkDirectoryWritable(dir)
+		}
+	}
+	return checks
+}
+
+// dataDirectories returns the local directories the configured stores write to
+func (app *App) dataDirectories() []string {
+	dirs := []string{}
+	seen := map[string]bool{}
+	add := func(dir string) {
+		dir = filepath.Clean(dir)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	if app.Config.BlobStore.Backend == "file" {
+		add(app.Config.BlobStore.Directory)
+	}
+	if app.Config.UserStore.Backend == "file" {
+		add(filepath.Dir(app.Config.UserStore.File))
+	}
+	if app.Config.SessionStore.Backend == "file" {
+		add(filepath.Dir(app.Config.SessionStore.File))
+	}
+	return dirs
+}
+
+// checkDirectoryWritable creates and removes a file in the directory
+func checkDirectoryWritable(dir string) error {
+	file, err := ioutil.TempFile(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func writeHealth(w http.ResponseWriter, status int, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
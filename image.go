@@ -1,16 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"image"
 	"io"
+	"io/ioutil"
 	"mime"
 	"mime/multipart"
 	"net/http"
-	"os"
 	"path/filepath"
 	"time"
 )
 
-const imageIDLength = 10
+const (
+	imageIDLength = 10
+
+	// The maximum number of pixels of an uploaded image
+	maxImagePixels = 50000000
+)
 
 // Image contains the images metadata
 type Image struct {
@@ -19,16 +26,20 @@ type Image struct {
 	Name        string
 	Location    string
 	Size        int64
+	MimeType    string
+	Width       int
+	Height      int
 	CreatedAt   time.Time
 	Description string
+	Variants    ImageVariants
 }
 
 // ImageStore is an abstraction interface to store Images
 type ImageStore interface {
 	Save(image *Image) error
 	Find(id string) (*Image, error)
-	FindAll(offset int) ([]Image, error)
-	FindAllByUser(user *User, offset int) ([]Image, error)
+	FindAll(offset, limit int) ([]Image, error)
+	FindAllByUser(user *User, offset, limit int) ([]Image, error)
 }
 
 // A map of accepted mime types and their file extension
@@ -47,75 +58,164 @@ func NewImage(user *User) *Image {
 	}
 }
 
-// CreateFromURL downloads an image from an URL
-func (image *Image) CreateFromURL(imageURL string) error {
-	// Get the response from the URL
-	response, err := http.Get(imageURL)
-	if err != nil {
-		return err
-	}
+// ShowRoute returns the path of the image's detail page
+func (image *Image) ShowRoute() string {
+	return "/image/" + image.ID
+}
 
-	// Make sure we got a response
-	if response.StatusCode != http.StatusOK {
-		return errImageURLInvalid
+// StaticRoute returns the path the raw image file is served from
+func (image *Image) StaticRoute() string {
+	return "/im/" + image.Location
+}
+
+// ContentType returns the mime type of the image, falling back to the one
+// matching the file extension for images stored without one
+func (image *Image) ContentType() string {
+	if image.MimeType != "" {
+		return image.MimeType
 	}
-	defer response.Body.Close()
 
-	// Ascertain the type of file we downloaded
-	mimeType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
-	if err != nil {
-		return errInvalidImageType
+	ext := filepath.Ext(image.Location)
+	for mimeType, mimeExt := range mimeExtensions {
+		if mimeExt == ext {
+			return mimeType
+		}
 	}
+	return mime.TypeByExtension(ext)
+}
 
-	// Get an extension for the file
-	ext, valid := mimeExtensions[mimeType]
-	if !valid {
-		return errInvalidImageType
+// CreateImageFromURL downloads an image from an URL
+func (app *App) CreateImageFromURL(image *Image, imageURL string) error {
+	data, err := app.Fetcher.Fetch(imageURL)
+	if err != nil {
+		return err
 	}
 
 	// Get a name from the URL
 	image.Name = filepath.Base(imageURL)
-	image.Location = image.ID + ext
 
-	// Open a file at target location
-	savedFile, err := os.Create("./data/images/" + image.Location)
+	err = app.saveImage(image, data)
 	if err != nil {
 		return err
 	}
-	defer savedFile.Close()
+	app.Metrics.ObserveUpload("url", image.Size)
+	return nil
+}
+
+// CreateImageFromFile uploads an image from the clients computer
+func (app *App) CreateImageFromFile(image *Image, file multipart.File, headers *multipart.FileHeader) error {
+	image.Name = headers.Filename
+	if headers.Size > app.Config.UploadMaxBytes {
+		return errImageTooBig
+	}
 
-	// Copy the entire response to the output flie
-	size, err := io.Copy(savedFile, response.Body)
+	// The header's size is reported by the client, so enforce the limit on
+	// the bytes actually read
+	data, err := ioutil.ReadAll(io.LimitReader(file, app.Config.UploadMaxBytes+1))
+	if isRequestTooLarge(err) {
+		return errImageTooBig
+	}
 	if err != nil {
 		return err
 	}
-	// The returned value from io.Copy is the number of bytes copied
-	image.Size = size
+	if int64(len(data)) > app.Config.UploadMaxBytes {
+		return errImageTooBig
+	}
 
-	// Save our image to the store
-	return globalImageStore.Save(image)
+	err = app.saveImage(image, data)
+	if err != nil {
+		return err
+	}
+	app.Metrics.ObserveUpload("file", image.Size)
+	return nil
 }
 
-// CreateFromFile uploads an image from the clients computer
-func (image *Image) CreateFromFile(file multipart.File, headers *multipart.FileHeader) error {
-	// Move our file to an appropriate place, with an appropriate name
-	image.Name = headers.Filename
-	image.Location = image.ID + filepath.Ext(image.Name)
+// saveImage validates the image data, writes it to the blob store together
+// with its variants and saves the image to the store
+func (app *App) saveImage(image *Image, data []byte) error {
+	// Ascertain the type of the image from its contents, never trust the
+	// client supplied file name or content type
+	mimeType, config, err := detectImage(data)
+	if err != nil {
+		app.Logger.Info("image rejected", "image_id", image.ID, "user_id", image.UserID, "error", err)
+		return err
+	}
+	image.MimeType = mimeType
+	image.Width = config.Width
+	image.Height = config.Height
+	image.Size = int64(len(data))
+	image.Location = image.ID + mimeExtensions[mimeType]
+
+	// Store the image data
+	err = app.Blobs.Put(image.Location, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
 
-	// Open a file at target location
-	savedFile, err := os.Create("./data/images/" + image.Location)
+	// Generate the thumbnail and resized versions
+	err = image.CreateVariants(app.Blobs, data, app.Logger)
 	if err != nil {
+		app.deleteImageBlobs(image)
 		return err
 	}
-	defer savedFile.Close()
 
-	// Copy the uploaded file to the target location
-	size, err := io.Copy(savedFile, file)
+	// Save our image to the store
+	err = app.Images.Save(image)
 	if err != nil {
+		app.deleteImageBlobs(image)
 		return err
 	}
-	image.Size = size
 
-	// Save the image to the database
-	return globalImageStore.Save(image)
+	app.Logger.Info("image stored",
+		"image_id", image.ID,
+		"user_id", image.UserID,
+		"mime_type", image.MimeType,
+		"size", image.Size,
+		"width", image.Width,
+		"height", image.Height,
+	)
+	return nil
+}
+
+// deleteImageBlobs removes the image data and its variants from the blob
+// store, so an image which couldn't be saved doesn't leave orphaned blobs.
+// Variants which weren't created yet are missing, which isn't an error.
+func (app *App) deleteImageBlobs(image *Image) {
+	locations := []string{image.Location}
+	for _, spec := range imageVariantSpecs {
+		locations = append(locations, image.VariantLocation(spec.Name))
+	}
+	for _, location := range locations {
+		err := app.Blobs.Delete(location)
+		if err != nil {
+			app.Logger.Error("deleting image blob failed", "image_id", image.ID, "location", location, "error", err)
+		}
+	}
+}
+
+// detectImage sniffs the mime type of the image data and decodes its header
+// to make sure the data really is an image of an accepted type
+func detectImage(data []byte) (string, image.Config, error) {
+	mimeType := http.DetectContentType(data)
+	if _, valid := mimeExtensions[mimeType]; !valid {
+		return "", image.Config{}, errInvalidImageType
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", image.Config{}, errImageInvalid
+	}
+
+	// The decoder has to agree with the sniffed content type
+	if "image/"+format != mimeType {
+		return "", image.Config{}, errImageInvalid
+	}
+
+	// Refuse to decode huge images, they'd exhaust the memory when
+	// generating the variants
+	if config.Width*config.Height > maxImagePixels {
+		return "", image.Config{}, errImageDimensionsTooLarge
+	}
+
+	return mimeType, config, nil
 }
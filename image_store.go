@@ -1,46 +1,55 @@
 package main
 
-import "database/sql"
-
-var globalImageStore ImageStore
-
-const pageSize = 25
+import (
+	"database/sql"
+	"sort"
+	"sync"
+)
 
 // DBImageStore is a database implementation of the ImageStore interface
 type DBImageStore struct {
-	db *sql.DB
+	db     *DB
+	logger *Logger
 }
 
-// NewDBImageStore returns a newly created mysql DBImageStore
-func NewDBImageStore() ImageStore {
+// NewDBImageStore returns a newly created DBImageStore on the given database
+func NewDBImageStore(db *DB, logger *Logger) ImageStore {
 	return &DBImageStore{
-		db: globalMySQLDB,
+		db:     db,
+		logger: logger,
 	}
 }
 
-// Save image in mysql database
+// Save image in the database
 func (store *DBImageStore) Save(image *Image) error {
-	_, err := store.db.Exec(`
-	REPLACE INTO images
-	  (id, user_id, name, location, description, size, created_at)
-	VALUES
-	   (?, ?, ?, ?, ?, ?, ?)
-	`,
+	_, err := store.db.Exec(store.db.Dialect.Replace("images",
+		"id", "user_id", "name", "location", "description", "size",
+		"mime_type", "width", "height", "created_at", "variants",
+	),
 		image.ID,
 		image.UserID,
 		image.Name,
 		image.Location,
 		image.Description,
 		image.Size,
-		image.CreatedAt,
+		image.MimeType,
+		image.Width,
+		image.Height,
+		store.db.Dialect.Timestamp(image.CreatedAt),
+		image.Variants,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	store.logger.Debug("image saved", "image_id", image.ID, "user_id", image.UserID)
+	return nil
 }
 
-// Find returns the image with the given id from the mysql database
+// Find returns the image with the given id from the database or nil
+// if not found
 func (store *DBImageStore) Find(id string) (*Image, error) {
 	row := store.db.QueryRow(`
-	SELECT id, user_id, name, location, description, size, created_at
+	SELECT id, user_id, name, location, description, size, mime_type, width, height, created_at, variants
 	FROM images
 	WHERE id = ?
 	`,
@@ -51,70 +60,66 @@ func (store *DBImageStore) Find(id string) (*Image, error) {
 	err := row.Scan(
 		&image.ID,
 		&image.UserID,
+		&image.Name,
 		&image.Location,
 		&image.Description,
 		&image.Size,
+		&image.MimeType,
+		&image.Width,
+		&image.Height,
 		&image.CreatedAt,
+		&image.Variants,
 	)
-	return &image, err
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &image, nil
 }
 
-// FindAll returns a list of images from the mysql database
-func (store *DBImageStore) FindAll(offset int) ([]Image, error) {
+// FindAll returns up to limit images from the database, newest first
+func (store *DBImageStore) FindAll(offset, limit int) ([]Image, error) {
 	rows, err := store.db.Query(`
-	SELECT id, user_id, name, location, description, size, created_at
+	SELECT id, user_id, name, location, description, size, mime_type, width, height, created_at, variants
 	FROM images
 	ORDER BY created_at DESC
-	LIMIT ?
-	OFFSET ?
-	`,
-		pageSize,
+	`+store.db.Dialect.LimitOffset(),
+		limit,
 		offset,
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	images := []Image{}
-	for rows.Next() {
-		image := Image{}
-		err := rows.Scan(
-			&image.ID,
-			&image.UserID,
-			&image.Name,
-			&image.Location,
-			&image.Description,
-			&image.Size,
-			&image.CreatedAt,
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		images = append(images, image)
-	}
-
-	return images, nil
+	return scanImages(rows)
 }
 
-// FindAllByUser returns a list of images of that user from the mysql database
-func (store *DBImageStore) FindAllByUser(user *User, offset int) ([]Image, error) {
+// FindAllByUser returns up to limit images of that user from the database,
+// newest first
+func (store *DBImageStore) FindAllByUser(user *User, offset, limit int) ([]Image, error) {
 	rows, err := store.db.Query(`
-		SELECT id, user_id, name, location, description, size, created_at
+		SELECT id, user_id, name, location, description, size, mime_type, width, height, created_at, variants
 		FROM images
 		WHERE user_id = ?
 		ORDER BY created_at DESC
-		LIMIT ?
-		OFFSET ?
-		`,
+		`+store.db.Dialect.LimitOffset(),
 		user.ID,
-		pageSize,
+		limit,
 		offset,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	return scanImages(rows)
+}
+
+// scanImages reads all images from the result set and closes it
+func scanImages(rows *sql.Rows) ([]Image, error) {
+	defer rows.Close()
+
 	images := []Image{}
 	for rows.Next() {
 		image := Image{}
@@ -125,7 +130,11 @@ func (store *DBImageStore) FindAllByUser(user *User, offset int) ([]Image, error
 			&image.Location,
 			&image.Description,
 			&image.Size,
+			&image.MimeType,
+			&image.Width,
+			&image.Height,
 			&image.CreatedAt,
+			&image.Variants,
 		)
 		if err != nil {
 			return nil, err
@@ -134,5 +143,80 @@ func (store *DBImageStore) FindAllByUser(user *User, offset int) ([]Image, error
 		images = append(images, image)
 	}
 
-	return images, nil
+	return images, rows.Err()
+}
+
+// MemoryImageStore is an in-memory implementation of the ImageStore
+// interface, which is safe for concurrent use. It's meant for tests and
+// development.
+type MemoryImageStore struct {
+	mutex  sync.RWMutex
+	images map[string]Image
+}
+
+// NewMemoryImageStore returns an empty MemoryImageStore
+func NewMemoryImageStore() *MemoryImageStore {
+	return &MemoryImageStore{
+		images: map[string]Image{},
+	}
+}
+
+// Save stores the image in memory
+func (store *MemoryImageStore) Save(image *Image) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.images[image.ID] = *image
+	return nil
+}
+
+// Find returns the image with the given id or nil if not found
+func (store *MemoryImageStore) Find(id string) (*Image, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	image, exists := store.images[id]
+	if !exists {
+		return nil, nil
+	}
+	return &image, nil
+}
+
+// FindAll returns up to limit images, newest first
+func (store *MemoryImageStore) FindAll(offset, limit int) ([]Image, error) {
+	return store.find(func(image *Image) bool {
+		return true
+	}, offset, limit), nil
+}
+
+// FindAllByUser returns up to limit images of that user, newest first
+func (store *MemoryImageStore) FindAllByUser(user *User, offset, limit int) ([]Image, error) {
+	return store.find(func(image *Image) bool {
+		return image.UserID == user.ID
+	}, offset, limit), nil
+}
+
+// find returns the page of matching images ordered by creation time
+func (store *MemoryImageStore) find(matches func(*Image) bool, offset, limit int) []Image {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	images := []Image{}
+	for _, image := range store.images {
+		if matches(&image) {
+			images = append(images, image)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].CreatedAt.After(images[j].CreatedAt)
+	})
+
+	if offset >= len(images) {
+		return []Image{}
+	}
+	images = images[offset:]
+	if limit < len(images) {
+		images = images[:limit]
+	}
+	return images
 }
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// failingImageStore fails to save any image
+type failingImageStore struct {
+	ImageStore
+}
+
+func (store failingImageStore) Save(image *Image) error {
+	return errors.New("database is gone")
+}
+
+func TestSaveImageDeletesBlobsOnFailure(t *testing.T) {
+	app := newTestApp(t, Stores{})
+	app.Images = failingImageStore{app.Images}
+
+	// Large enough for all variants
+	var data bytes.Buffer
+	err := png.Encode(&data, image.NewRGBA(image.Rect(0, 0, 1600, 1200)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := NewImage(&User{ID: "usr_1"})
+	err = app.saveImage(img, data.Bytes())
+	if err == nil {
+		t.Fatal("saveImage succeeded with a failing image store")
+	}
+	if len(img.Variants) != len(imageVariantSpecs) {
+		t.Fatalf("%d variants were created, want %d", len(img.Variants), len(imageVariantSpecs))
+	}
+
+	locations := []string{img.Location}
+	for _, spec := range imageVariantSpecs {
+		locations = append(locations, img.VariantLocation(spec.Name))
+	}
+	for _, location := range locations {
+		if _, err := app.Blobs.Stat(location); err != errBlobNotFound {
+			t.Errorf("Stat(%s) = %v, want %v", location, err, errBlobNotFound)
+		}
+	}
+}
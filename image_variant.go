@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ImageVariant holds the dimensions of a resized copy of an image
+type ImageVariant struct {
+	Width  int
+	Height int
+}
+
+// ImageVariants maps the variant names to the generated variants of an image
+type ImageVariants map[string]ImageVariant
+
+// imageVariantSpec describes how a variant is derived from the original image
+type imageVariantSpec struct {
+	Name   string
+	Width  int
+	Square bool
+}
+
+// The variants generated for every uploaded image
+var imageVariantSpecs = []imageVariantSpec{
+	{Name: "thumb", Width: 150, Square: true},
+	{Name: "medium", Width: 600},
+	{Name: "large", Width: 1200},
+}
+
+const jpegQuality = 85
+
+// Value stores the variants as json in the database
+func (variants ImageVariants) Value() (driver.Value, error) {
+	if variants == nil {
+		return "{}", nil
+	}
+	contents, err := json.Marshal(variants)
+	if err != nil {
+		return nil, err
+	}
+	return string(contents), nil
+}
+
+// Scan reads the variants from their json database representation
+func (variants *ImageVariants) Scan(src interface{}) error {
+	var contents []byte
+	switch value := src.(type) {
+	case nil:
+		*variants = ImageVariants{}
+		return nil
+	case []byte:
+		contents = value
+	case string:
+		contents = []byte(value)
+	default:
+		return fmt.Errorf("Can't scan image variants from %T", src)
+	}
+	return json.Unmarshal(contents, variants)
+}
+
+// VariantLocation returns the file name of the given variant
+func (image *Image) VariantLocation(name string) string {
+	ext := filepath.Ext(image.Location)
+	return image.ID + "_" + name + ext
+}
+
+// VariantRoute returns the path the given variant is served from. Missing
+// variants are served as the original image by HandleImageFile.
+func (image *Image) VariantRoute(name string) string {
+	return "/im/" + image.VariantLocation(name)
+}
+
+// parseImageLocation splits a requested file location into the image id and
+// the variant name, which is empty for the original image
+func parseImageLocation(location string) (id, variant string) {
+	base := strings.TrimSuffix(location, filepath.Ext(location))
+	for _, spec := range imageVariantSpecs {
+		if strings.HasSuffix(base, "_"+spec.Name) {
+			return strings.TrimSuffix(base, "_"+spec.Name), spec.Name
+		}
+	}
+	return base, ""
+}
+
+// CreateVariants generates the resized variants from the original image data,
+// puts them into the blob store and records their dimensions
+func (image *Image) CreateVariants(blobs BlobStore, data []byte, logger *Logger) error {
+	original, format, err := decodeImage(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	image.Variants = ImageVariants{}
+	for _, spec := range imageVariantSpecs {
+		start := time.Now()
+		resized := spec.Resize(original)
+		if resized == nil {
+			// The original is small enough already
+			logger.Debug("image variant skipped", "image_id", image.ID, "variant", spec.Name)
+			continue
+		}
+
+		err := saveImageVariant(blobs, image.VariantLocation(spec.Name), resized, format)
+		if err != nil {
+			logger.Error("saving image variant failed", "image_id", image.ID, "variant", spec.Name, "error", err)
+			return err
+		}
+
+		size := resized.Bounds().Size()
+		logger.Debug("image variant created",
+			"image_id", image.ID,
+			"variant", spec.Name,
+			"width", size.X,
+			"height", size.Y,
+			"duration", time.Since(start),
+		)
+		image.Variants[spec.Name] = ImageVariant{
+			Width:  size.X,
+			Height: size.Y,
+		}
+	}
+	return nil
+}
+
+// decodeImage decodes the image into an RGBA image, which allows fast
+// access to the pixels while resizing
+func decodeImage(r io.Reader) (*image.RGBA, string, error) {
+	src, format, err := image.Decode(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	bounds := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	return rgba, format, nil
+}
+
+// saveImageVariant encodes the image in the given format and puts it into
+// the blob store
+func saveImageVariant(blobs BlobStore, location string, img image.Image, format string) error {
+	buf := bytes.NewBuffer(nil)
+
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: jpegQuality})
+	case "png":
+		err = png.Encode(buf, img)
+	case "gif":
+		err = gif.Encode(buf, img, nil)
+	default:
+		err = errors.New("Unsupported image format " + format)
+	}
+	if err != nil {
+		return err
+	}
+
+	return blobs.Put(location, buf)
+}
+
+// Resize returns the variant of the given image or nil if the image is
+// already smaller than the variant
+func (spec imageVariantSpec) Resize(src *image.RGBA) *image.RGBA {
+	size := src.Bounds().Size()
+
+	if spec.Square {
+		// Crop the largest possible square from the center
+		side := size.X
+		if size.Y < side {
+			side = size.Y
+		}
+		x := (size.X - side) / 2
+		y := (size.Y - side) / 2
+		crop := image.Rect(x, y, x+side, y+side)
+
+		width := spec.Width
+		if side < width {
+			width = side
+		}
+		return resizeImage(src, crop, width, width)
+	}
+
+	if size.X <= spec.Width {
+		return nil
+	}
+
+	height := size.Y * spec.Width / size.X
+	if height < 1 {
+		height = 1
+	}
+	return resizeImage(src, src.Bounds(), spec.Width, height)
+}
+
+// resizeImage scales the given area of the source image down to the given
+// dimensions by averaging all source pixels covered by a target pixel
+func resizeImage(src *image.RGBA, area image.Rectangle, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	areaWidth, areaHeight := area.Dx(), area.Dy()
+
+	for y := 0; y < height; y++ {
+		y0 := area.Min.Y + y*areaHeight/height
+		y1 := area.Min.Y + (y+1)*areaHeight/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < width; x++ {
+			x0 := area.Min.X + x*areaWidth/width
+			x1 := area.Min.X + (x+1)*areaWidth/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, count uint64
+			for sy := y0; sy < y1; sy++ {
+				offset := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(src.Pix[offset])
+					g += uint64(src.Pix[offset+1])
+					b += uint64(src.Pix[offset+2])
+					a += uint64(src.Pix[offset+3])
+					offset += 4
+					count++
+				}
+			}
+
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset] = uint8(r / count)
+			dst.Pix[offset+1] = uint8(g / count)
+			dst.Pix[offset+2] = uint8(b / count)
+			dst.Pix[offset+3] = uint8(a / count)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log entry
+type LogLevel int
+
+// The log levels in increasing severity
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (level LogLevel) String() string {
+	if level < LevelDebug || level > LevelError {
+		return "level(" + strconv.Itoa(int(level)) + ")"
+	}
+	return logLevelNames[level]
+}
+
+// ParseLogLevel returns the level with the given name
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return LogLevel(level), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+}
+
+// LogConfig selects where and how much is logged
+type LogConfig struct {
+	// Level is the minimum level logged, debug, info, warn or error
+	Level string `yaml:"level"`
+	// Format is either "json" or "logfmt"
+	Format string `yaml:"format"`
+	// Output is "stderr", "stdout" or the name of a file logs are appended to
+	Output string `yaml:"output"`
+}
+
+// Logger writes structured, leveled log entries in JSON or logfmt format. It
+// is safe for concurrent use and a nil Logger discards everything, so stores
+// and helpers may be used without one.
+type Logger struct {
+	output *logOutput
+	level  LogLevel
+	json   bool
+	fields []interface{}
+}
+
+// logOutput serializes the writes of a Logger and the loggers derived from it
+type logOutput struct {
+	mutex sync.Mutex
+	out   io.Writer
+}
+
+// NewLogger returns a Logger writing entries of at least the given level to
+// out, format is either "json" or "logfmt"
+func NewLogger(out io.Writer, format string, level LogLevel) *Logger {
+	return &Logger{
+		output: &logOutput{out: out},
+		level:  level,
+		json:   format == "json",
+	}
+}
+
+// OpenLogger returns a Logger writing to the output selected by the config
+func OpenLogger(config LogConfig) (*Logger, error) {
+	level, err := ParseLogLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	var out io.Writer
+	switch config.Output {
+	case "", "stderr":
+		out = os.Stderr
+	case "stdout":
+		out = os.Stdout
+	default:
+		out, err = os.OpenFile(config.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("Error opening log file: %s", err)
+		}
+	}
+
+	return NewLogger(out, config.Format, level), nil
+}
+
+// With returns a Logger adding the given key value pairs to every entry
+func (logger *Logger) With(fields ...interface{}) *Logger {
+	if logger == nil {
+		return nil
+	}
+
+	derived := *logger
+	derived.fields = append(append([]interface{}{}, logger.fields...), fields...)
+	return &derived
+}
+
+// Enabled returns true if entries of the given level are written
+func (logger *Logger) Enabled(level LogLevel) bool {
+	return logger != nil && level >= logger.level
+}
+
+// Debug logs a message with the given key value pairs at debug level
+func (logger *Logger) Debug(msg string, fields ...interface{}) {
+	logger.Log(LevelDebug, msg, fields...)
+}
+
+// Info logs a message with the given key value pairs at info level
+func (logger *Logger) Info(msg string, fields ...interface{}) {
+	logger.Log(LevelInfo, msg, fields...)
+}
+
+// Warn logs a message with the given key value pairs at warn level
+func (logger *Logger) Warn(msg string, fields ...interface{}) {
+	logger.Log(LevelWarn, msg, fields...)
+}
+
+// Error logs a message with the given key value pairs at error level
+func (logger *Logger) Error(msg string, fields ...interface{}) {
+	logger.Log(LevelError, msg, fields...)
+}
+
+// Log writes an entry with the message and the key value pairs, if the
+// level is enabled
+func (logger *Logger) Log(level LogLevel, msg string, fields ...interface{}) {
+	if !logger.Enabled(level) {
+		return
+	}
+
+	entry := []interface{}{
+		"time", time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		"level", level.String(),
+		"msg", msg,
+	}
+	entry = append(entry, logger.fields...)
+	entry = append(entry, fields...)
+
+	buf := bytes.NewBuffer(nil)
+	if logger.json {
+		writeJSONEntry(buf, entry)
+	} else {
+		writeLogfmtEntry(buf, entry)
+	}
+
+	logger.output.mutex.Lock()
+	defer logger.output.mutex.Unlock()
+	logger.output.out.Write(buf.Bytes())
+}
+
+// writeJSONEntry writes the key value pairs as one line JSON object
+func writeJSONEntry(buf *bytes.Buffer, entry []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(entry); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(entry[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		value, err := json.Marshal(logValue(entry, i+1))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(logValue(entry, i+1)))
+		}
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+}
+
+// writeLogfmtEntry writes the key value pairs as one logfmt line
+func writeLogfmtEntry(buf *bytes.Buffer, entry []interface{}) {
+	for i := 0; i < len(entry); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(entry[i]))
+		buf.WriteByte('=')
+
+		value := fmt.Sprint(logValue(entry, i+1))
+		if value == "" || strings.ContainsAny(value, " =\"\\\n\t") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+	buf.WriteByte('\n')
+}
+
+// logValue returns the value at index i of the entry in a form both formats
+// render readably
+func logValue(entry []interface{}, i int) interface{} {
+	if i >= len(entry) {
+		return "(missing)"
+	}
+
+	switch value := entry[i].(type) {
+	case error:
+		return value.Error()
+	case time.Duration:
+		return value.String()
+	case fmt.Stringer:
+		return value.String()
+	}
+	return entry[i]
+}
@@ -1,69 +1,129 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"flag"
 	"log"
 	"net/http"
-	"text/template"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/julienschmidt/httprouter"
 )
 
-var templates = template.Must(template.New("t").ParseGlob("templates/**/*.html"))
+func main() {
+	config, args, err := LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 
-func init() {
-	// Assign a user store
-	store, err := NewFileUserStore("./data/users.yaml")
+	logger, err := OpenLogger(config.Log)
 	if err != nil {
-		panic(fmt.Errorf("Error creating user store: %s", err))
+		log.Fatal(err)
 	}
-	globalUserStore = store
 
-	// Assign a session store
-	sessionStore, err := NewFileSessionStore("./data/sessions.yaml")
+	stores, err := OpenStores(config, logger)
 	if err != nil {
-		panic(fmt.Errorf("Error creating session store: %s", err))
+		log.Fatal(err)
 	}
-	globalSessionStore = sessionStore
 
-	// Assign a sql database
-	db, err := NewMySQLDB("gophr:SOTWIZiniw@tcp(127.0.0.1:3306)/gophr")
+	// "gophr migrate ..." manages the database schema instead of serving
+	if len(args) > 0 && args[0] == "migrate" {
+		err := RunMigrateCommand(stores.DB, args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Bring the database schema up to date before serving requests
+	migrator, err := NewMigrator(stores.DB)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
+	}
+	applied, err := migrator.Up()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, migration := range applied {
+		logger.Info("migration applied", "version", migration.Version, "name", migration.Name)
+	}
+
+	app, err := NewApp(config, stores, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Remove expired sessions in the background
+	sweeper := NewSessionSweeper(app.Sessions.(ExpiredSessionDeleter), sessionSweepInterval, logger.With("component", "sweeper"))
+	sweeper.Start()
+
+	servers := []*http.Server{
+		newServer(config, config.ListenAddress, app),
+	}
+	// The metrics are served on their own, internal address only
+	if config.MetricsAddress != "" {
+		servers = append(servers, newServer(config, config.MetricsAddress, app.MetricsHandler()))
+	}
+
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		server := server
+		go func() {
+			logger.Info("listening", "address", server.Addr)
+			err := server.ListenAndServe()
+			if err != http.ErrServerClosed {
+				errs <- err
+			}
+		}()
+	}
+
+	// Serve until the process is asked to terminate or a server fails
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case <-ctx.Done():
+		logger.Info("shutting down")
+	case err := <-errs:
+		logger.Error("server failed, shutting down", "error", err)
 	}
-	globalMySQLDB = db
 
-	// Assign an image store
-	globalImageStore = NewDBImageStore()
+	// Stop accepting connections and let in-flight requests finish, then
+	// stop the background workers and close the stores
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Error("shutting down server failed", "address", server.Addr, "error", err)
+		}
+	}
+
+	sweeper.Stop()
+	err = stores.Close()
+	if err != nil {
+		logger.Error("closing stores failed", "error", err)
+	}
+	logger.Info("stopped")
 }
 
-func main() {
-	router := NewRouter()
-	router.Handle("GET", "/", HandleHome)
-	router.Handle("GET", "/register", HandleUserNew)
-	router.Handle("POST", "/register", HandleUserCreate)
-	router.Handle("GET", "/login", HandleSessionNew)
-	router.Handle("POST", "/login", HandleSessionCreate)
-	router.ServeFiles("/assets/*filepath", http.Dir("assets/"))
-
-	secureRouter := NewRouter()
-	secureRouter.Handle("GET", "/signout", HandleSessionDestroy)
-	secureRouter.Handle("GET", "/account", HandleUserEdit)
-	secureRouter.Handle("POST", "/account", HandleUserUpdate)
-	secureRouter.Handle("GET", "/images/new", HandleImageNew)
-	secureRouter.Handle("POST", "/images/new", HandleImageCreate)
-
-	middleware := Middleware{}
-	middleware.Add(router)
-	middleware.Add(http.HandlerFunc(RequireLogin))
-	middleware.Add(secureRouter)
-
-	log.Fatal(http.ListenAndServe(":3000", middleware))
+// newServer returns a http.Server for the handler with the configured timeouts
+func newServer(config *Config, address string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: config.ReadTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
 }
 
 // NewRouter creates a new router
 func NewRouter() *httprouter.Router {
-	router := httprouter.New()
-	router.NotFound = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
-	return router
+	return httprouter.New()
 }
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default histogram buckets in seconds for request and store latencies
+var (
+	requestDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	storeDurationBuckets   = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+)
+
+// Metrics collects the application's metrics and exposes them in the
+// Prometheus text format
+type Metrics struct {
+	collectors []metricCollector
+
+	Requests        *CounterVec
+	RequestDuration *HistogramVec
+	Uploads         *CounterVec
+	UploadBytes     *CounterVec
+	StoreDuration   *HistogramVec
+	StoreErrors     *CounterVec
+}
+
+// metricCollector writes one metric family in the Prometheus text format
+type metricCollector interface {
+	writeMetrics(w io.Writer)
+}
+
+// NewMetrics returns Metrics with all application metrics registered
+func NewMetrics() *Metrics {
+	metrics := &Metrics{}
+	metrics.Requests = metrics.NewCounterVec("gophr_http_requests_total",
+		"Number of HTTP requests served.", "method", "route", "status")
+	metrics.RequestDuration = metrics.NewHistogramVec("gophr_http_request_duration_seconds",
+		"Latency of HTTP requests.", requestDurationBuckets, "method", "route")
+	metrics.Uploads = metrics.NewCounterVec("gophr_uploads_total",
+		"Number of images uploaded.", "source")
+	metrics.UploadBytes = metrics.NewCounterVec("gophr_upload_bytes_total",
+		"Size of the images uploaded in bytes.", "source")
+	metrics.StoreDuration = metrics.NewHistogramVec("gophr_store_operation_duration_seconds",
+		"Latency of store operations.", storeDurationBuckets, "store", "operation")
+	metrics.StoreErrors = metrics.NewCounterVec("gophr_store_operation_errors_total",
+		"Number of failed store operations.", "store", "operation")
+	return metrics
+}
+
+// NewCounterVec registers a counter with the given label names
+func (metrics *Metrics) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	counter := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: map[string]*counterValue{},
+	}
+	metrics.collectors = append(metrics.collectors, counter)
+	return counter
+}
+
+// NewHistogramVec registers a histogram with the given upper bucket bounds
+// and label names
+func (metrics *Metrics) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	histogram := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  map[string]*histogramValue{},
+	}
+	metrics.collectors = append(metrics.collectors, histogram)
+	return histogram
+}
+
+// NewGaugeFunc registers a gauge whose values are returned by collect when
+// the metrics are scraped. Errors skip the gauge for that scrape.
+func (metrics *Metrics) NewGaugeFunc(name, help string, collect func() (float64, error)) {
+	metrics.collectors = append(metrics.collectors, &gaugeFunc{
+		name:    name,
+		help:    help,
+		collect: collect,
+	})
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format
+func (metrics *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	buf := bufio.NewWriter(w)
+	for _, collector := range metrics.collectors {
+		collector.writeMetrics(buf)
+	}
+	buf.Flush()
+}
+
+// ObserveRequest records a served HTTP request
+func (metrics *Metrics) ObserveRequest(method, route string, status int, duration time.Duration) {
+	metrics.Requests.Add(1, method, route, strconv.Itoa(status))
+	metrics.RequestDuration.Observe(duration.Seconds(), method, route)
+}
+
+// ObserveUpload records an uploaded image of the given source, file or url
+func (metrics *Metrics) ObserveUpload(source string, bytes int64) {
+	metrics.Uploads.Add(1, source)
+	metrics.UploadBytes.Add(float64(bytes), source)
+}
+
+// ObserveStore records a store operation which started at start. Validation
+// errors aren't counted as failures.
+func (metrics *Metrics) ObserveStore(store, operation string, start time.Time, err error) {
+	metrics.StoreDuration.Observe(time.Since(start).Seconds(), store, operation)
+	if err != nil && !IsValidationError(err) {
+		metrics.StoreErrors.Add(1, store, operation)
+	}
+}
+
+// Middleware records the count and latency of every request by its route
+func (metrics *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		mw := NewMiddlewareResponseWriter(w)
+		r, record := withRequestRecord(r)
+
+		defer func() {
+			route := record.Route
+			if route == "" {
+				route = "unmatched"
+			}
+			metrics.ObserveRequest(methodLabel(r.Method), route, mw.Status(), time.Since(start))
+		}()
+
+		next.ServeHTTP(mw, r)
+	})
+}
+
+// methodLabel returns the method as metric label. Clients can send any
+// method, so all but the standard ones are counted as "other" to keep the
+// number of series bounded.
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		return method
+	}
+	return "other"
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mutex  sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+// Add increases the counter with the given label values
+func (counter *CounterVec) Add(delta float64, labels ...string) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	key := strings.Join(labels, "\xff")
+	value, ok := counter.values[key]
+	if !ok {
+		value = &counterValue{labels: labels}
+		counter.values[key] = value
+	}
+	value.value += delta
+}
+
+func (counter *CounterVec) writeMetrics(w io.Writer) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+
+	writeMetricHeader(w, counter.name, counter.help, "counter")
+	for _, key := range sortedKeys(counter.values) {
+		value := counter.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", counter.name, formatLabels(counter.labels, value.labels), formatMetricValue(value.value))
+	}
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mutex  sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Observe adds a value to the histogram with the given label values
+func (histogram *HistogramVec) Observe(observed float64, labels ...string) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	key := strings.Join(labels, "\xff")
+	value, ok := histogram.values[key]
+	if !ok {
+		value = &histogramValue{
+			labels: labels,
+			counts: make([]uint64, len(histogram.buckets)),
+		}
+		histogram.values[key] = value
+	}
+
+	for i, bound := range histogram.buckets {
+		if observed <= bound {
+			value.counts[i]++
+		}
+	}
+	value.count++
+	value.sum += observed
+}
+
+func (histogram *HistogramVec) writeMetrics(w io.Writer) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	writeMetricHeader(w, histogram.name, histogram.help, "histogram")
+	bucketLabels := append(append([]string{}, histogram.labels...), "le")
+	for _, key := range sortedKeys(histogram.values) {
+		value := histogram.values[key]
+		for i, bound := range histogram.buckets {
+			labels := append(append([]string{}, value.labels...), formatMetricValue(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, formatLabels(bucketLabels, labels), value.counts[i])
+		}
+		labels := append(append([]string{}, value.labels...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, formatLabels(bucketLabels, labels), value.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", histogram.name, formatLabels(histogram.labels, value.labels), formatMetricValue(value.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", histogram.name, formatLabels(histogram.labels, value.labels), value.count)
+	}
+}
+
+// gaugeFunc is a gauge whose value is collected on every scrape
+type gaugeFunc struct {
+	name    string
+	help    string
+	collect func() (float64, error)
+}
+
+func (gauge *gaugeFunc) writeMetrics(w io.Writer) {
+	value, err := gauge.collect()
+	if err != nil {
+		return
+	}
+
+	writeMetricHeader(w, gauge.name, gauge.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", gauge.name, formatMetricValue(value))
+}
+
+func writeMetricHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// formatLabels returns the {name="value",...} part of a sample
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelEscaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of a metric's values in a stable order
+func sortedKeys(values interface{}) []string {
+	keys := []string{}
+	switch values := values.(type) {
+	case map[string]*counterValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
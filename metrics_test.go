@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsMiddlewareMethodLabel(t *testing.T) {
+	metrics := NewMetrics()
+	handler := metrics.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	methods := []string{"GET", "POST", "OPTIONS", "PROPFIND", "BREW", "get"}
+	for _, method := range methods {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/", nil))
+	}
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	tests := []struct {
+		sample string
+		want   bool
+	}{
+		{`gophr_http_requests_total{method="GET",route="unmatched",status="200"} 1`, true},
+		{`gophr_http_requests_total{method="POST",route="unmatched",status="200"} 1`, true},
+		{`gophr_http_requests_total{method="OPTIONS",route="unmatched",status="200"} 1`, true},
+		{`gophr_http_requests_total{method="other",route="unmatched",status="200"} 3`, true},
+		{`gophr_http_request_duration_seconds_count{method="other",route="unmatched"} 3`, true},
+		{`method="PROPFIND"`, false},
+		{`method="BREW"`, false},
+		{`method="get"`, false},
+	}
+	for _, test := range tests {
+		if got := strings.Contains(body, test.sample); got != test.want {
+			t.Errorf("metrics contain %s = %v, want %v", test.sample, got, test.want)
+		}
+	}
+}
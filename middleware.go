@@ -1,14 +1,170 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
 
-// Middleware is a chain of http handlers
-type Middleware []http.Handler
+const (
+	requestIDHeader    = "X-Request-ID"
+	requestIDLength    = 16
+	maxRequestIDLength = 64
 
-// MiddlewareResponseWriter marks if it has written to the http ResponseWriter
+	// Request bodies may exceed the upload limit by this much, which leaves
+	// room for the other form fields and the multipart encoding
+	maxFormOverhead = 1 << 20
+	// Multipart forms larger than this are buffered in temporary files
+	maxFormMemory = 32 << 20
+)
+
+// Middleware wraps a handler with additional behaviour, e.g. authentication
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps the handler with the middlewares. The first middleware is the
+// outermost one and sees the request first.
+func Chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// RequestIDMiddleware tags every request with an ID, which is stored in the
+// request context and sent back in the X-Request-ID header. IDs passed in by
+// a proxy are kept.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = GenerateID("req", requestIDLength)
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestID returns the ID RequestIDMiddleware assigned to the request
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// Recover is a middleware which turns panicking handlers into a logged error
+// and a 500 error page, unless the handler already started its response
+func (app *App) Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mw := NewMiddlewareResponseWriter(w)
+
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// the client went away, there's nothing left to report
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			app.Logger.Error("panic serving request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"request_id", RequestID(r),
+				"panic", fmt.Sprint(err),
+				"stack", string(debug.Stack()),
+			)
+			if !mw.written {
+				app.RenderError(w, r, http.StatusInternalServerError)
+			}
+		}()
+
+		next.ServeHTTP(mw, r)
+	})
+}
+
+// LimitRequestBody is a middleware which refuses request bodies larger than
+// an image upload. Bodies without a Content-Length fail while being read.
+func (app *App) LimitRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := app.Config.UploadMaxBytes + maxFormOverhead
+		if r.ContentLength > limit {
+			app.RenderError(w, r, http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isRequestTooLarge returns true if reading the request body failed because
+// it exceeded the limit set by LimitRequestBody
+func isRequestTooLarge(err error) bool {
+	return errors.As(err, new(*http.MaxBytesError))
+}
+
+// requestRecord collects values about a request for the access log and the
+// metrics, which are only known to inner middlewares and handlers
+type requestRecord struct {
+	UserID string
+	Route  string
+}
+
+// withRequestRecord returns the request together with its record, which is
+// added to the request context if it doesn't have one yet
+func withRequestRecord(r *http.Request) (*http.Request, *requestRecord) {
+	if record := requestRecordOf(r); record != nil {
+		return r, record
+	}
+
+	record := &requestRecord{}
+	ctx := context.WithValue(r.Context(), requestRecordContextKey, record)
+	return r.WithContext(ctx), record
+}
+
+// requestRecordOf returns the record of the request or nil if nobody keeps
+// one
+func requestRecordOf(r *http.Request) *requestRecord {
+	record, _ := r.Context().Value(requestRecordContextKey).(*requestRecord)
+	return record
+}
+
+// AccessLog is a middleware which logs every request with its status, size
+// and latency once it has been served
+func (app *App) AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		mw := NewMiddlewareResponseWriter(w)
+		r, record := withRequestRecord(r)
+
+		defer func() {
+			app.Logger.Info("request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", mw.Status(),
+				"bytes", mw.bytes,
+				"latency_ms", float64(time.Since(start).Microseconds())/1000,
+				"user_id", record.UserID,
+				"request_id", RequestID(r),
+			)
+		}()
+
+		next.ServeHTTP(mw, r)
+	})
+}
+
+// MiddlewareResponseWriter records if, what status and how many bytes have
+// been written to the http ResponseWriter
 type MiddlewareResponseWriter struct {
 	http.ResponseWriter
 	written bool
+	status  int
+	bytes   int64
 }
 
 // NewMiddlewareResponseWriter returns a new MiddlewareResponseWriter
@@ -19,38 +175,28 @@ func NewMiddlewareResponseWriter(w http.ResponseWriter) *MiddlewareResponseWrite
 }
 
 func (w *MiddlewareResponseWriter) Write(bytes []byte) (int, error) {
-	w.written = true
-	return w.ResponseWriter.Write(bytes)
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(bytes)
+	w.bytes += int64(n)
+	return n, err
 }
 
 // WriteHeader writes the http header to the ResponseWriter
 func (w *MiddlewareResponseWriter) WriteHeader(code int) {
+	if !w.written {
+		w.status = code
+	}
 	w.written = true
 	w.ResponseWriter.WriteHeader(code)
 }
 
-// Add adds a handler to the middleware list
-func (m *Middleware) Add(handler http.Handler) {
-	*m = append(*m, handler)
-}
-
-// ServeHTTP processes all handlers in the chain and stops as soon as a
-// handler has written to the ResponseWriter or returns a 404 if no handlers has
-// written anything
-func (m Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Process the middleware
-	mw := NewMiddlewareResponseWriter(w)
-
-	// Loop through all registered handlers
-	for _, handler := range m {
-		// call the handler with our MiddlewareResponseWriter
-		handler.ServeHTTP(mw, r)
-
-		// stop processing the chain when there has been an output
-		if mw.written {
-			return
-		}
+// Status returns the status code of the response, which is 200 if nothing
+// has been written yet
+func (w *MiddlewareResponseWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
 	}
-	// If no handlers in the chain wrote a response, we return a 404
-	http.NotFound(w, r)
+	return w.status
 }
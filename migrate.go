@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The migrations of every dialect live in a directory named after it
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+// Name of the lock preventing two instances from migrating at the same time
+const migrationLockName = "gophr_migrations"
+
+// How long to wait for another instance to finish migrating
+const migrationLockTimeout = 60 * time.Second
+
+// legacyTable describes a table deployments created by hand before there
+// were migrations, and the migration which creates it nowadays
+type legacyTable struct {
+	Version int
+	Table   string
+	// Columns maps the columns hand made tables may lack to the definitions
+	// they are added with
+	Columns [][2]string
+	// Indexes maps the index names to their columns
+	Indexes [][2]string
+}
+
+// The images table used to be created by hand with the columns the original
+// queries used. Such tables are adopted instead of running the migration
+// creating the table: the missing columns and indexes are added and the
+// migration is recorded as applied.
+var legacyTables = []legacyTable{{
+	Version: 1,
+	Table:   "images",
+	Columns: [][2]string{
+		{"name", "VARCHAR(255) NOT NULL DEFAULT ''"},
+		{"size", "BIGINT NOT NULL DEFAULT 0"},
+		{"mime_type", "VARCHAR(64) NOT NULL DEFAULT ''"},
+		{"width", "INT NOT NULL DEFAULT 0"},
+		{"height", "INT NOT NULL DEFAULT 0"},
+		// MySQL doesn't allow defaults for TEXT columns, NULL is read as
+		// no variants
+		{"variants", "TEXT NULL"},
+	},
+	Indexes: [][2]string{
+		{"images_created_at", "created_at"},
+		{"images_user_id_created_at", "user_id, created_at"},
+	},
+}}
+
+// Migration is a versioned change of the database schema
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrator applies the embedded migrations to a database and records the
+// applied versions in the schema_migrations table
+type Migrator struct {
+	db         *DB
+	migrations []Migration
+}
+
+// NewMigrator returns a Migrator for the database with all embedded
+// migrations of its dialect loaded
+func NewMigrator(db *DB) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, path.Join("migrations", db.Dialect.Name()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{
+		db:         db,
+		migrations: migrations,
+	}, nil
+}
+
+// loadMigrations reads the migrations from files named
+// <version>_<name>.up.sql and <version>_<name>.down.sql
+func loadMigrations(files fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(files, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		filename := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(filename, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(filename, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(filename, "."+direction+".sql")
+		parts := strings.SplitN(base, "_", 2)
+		version, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid migration file name %s", filename)
+		}
+
+		contents, err := fs.ReadFile(files, path.Join(dir, filename))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, exists := byVersion[version]
+		if !exists {
+			migration = &Migration{Version: version, Name: parts[1]}
+			byVersion[version] = migration
+		}
+		if migration.Name != parts[1] {
+			return nil, fmt.Errorf("Migration %d has conflicting names %s and %s", version, migration.Name, parts[1])
+		}
+
+		if direction == "up" {
+			migration.Up = string(contents)
+		} else {
+			migration.Down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("Migration %d_%s has no up migration", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Up applies all pending migrations and returns the applied ones
+func (migrator *Migrator) Up() ([]Migration, error) {
+	applied := []Migration{}
+	err := migrator.withLock(func(conn *sql.Conn, current map[int]bool) error {
+		adopted, err := migrator.adoptLegacyTables(conn, current)
+		if err != nil {
+			return err
+		}
+		applied = append(applied, adopted...)
+
+		for _, migration := range migrator.migrations {
+			if current[migration.Version] {
+				continue
+			}
+
+			err = execStatements(conn, migration.Up)
+			if err != nil {
+				return fmt.Errorf("Migration %d_%s failed: %s", migration.Version, migration.Name, err)
+			}
+
+			err = migrator.record(conn, migration)
+			if err != nil {
+				return err
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// record adds the migration to the applied ones in schema_migrations
+func (migrator *Migrator) record(conn *sql.Conn, migration Migration) error {
+	_, err := conn.ExecContext(context.Background(), `
+	INSERT INTO schema_migrations
+	  (version, name, applied_at)
+	VALUES
+	  (?, ?, ?)
+	`,
+		migration.Version,
+		migration.Name,
+		migrator.db.Dialect.Timestamp(time.Now()),
+	)
+	return err
+}
+
+// adoptLegacyTables brings hand made tables up to the schema of the
+// migration creating them and records the migration as applied, so it
+// doesn't fail on the existing table. The adopted migrations are returned.
+func (migrator *Migrator) adoptLegacyTables(conn *sql.Conn, current map[int]bool) ([]Migration, error) {
+	ctx := context.Background()
+	adopted := []Migration{}
+
+	for _, legacy := range legacyTables {
+		if current[legacy.Version] {
+			continue
+		}
+
+		columns, indexes, err := migrator.db.Dialect.TableSchema(conn, legacy.Table)
+		if err != nil {
+			return nil, err
+		}
+		if len(columns) == 0 {
+			continue
+		}
+
+		for _, column := range legacy.Columns {
+			if columns[column[0]] {
+				continue
+			}
+			_, err := conn.ExecContext(ctx, "ALTER TABLE "+legacy.Table+" ADD COLUMN "+column[0]+" "+column[1])
+			if err != nil {
+				return nil, fmt.Errorf("Adding column %s to the existing %s table failed: %s", column[0], legacy.Table, err)
+			}
+		}
+
+		for _, index := range legacy.Indexes {
+			if indexes[index[0]] {
+				continue
+			}
+			_, err := conn.ExecContext(ctx, "CREATE INDEX "+index[0]+" ON "+legacy.Table+" ("+index[1]+")")
+			if err != nil {
+				return nil, fmt.Errorf("Adding index %s to the existing %s table failed: %s", index[0], legacy.Table, err)
+			}
+		}
+
+		for _, migration := range migrator.migrations {
+			if migration.Version != legacy.Version {
+				continue
+			}
+			err = migrator.record(conn, migration)
+			if err != nil {
+				return nil, err
+			}
+			adopted = append(adopted, migration)
+		}
+		current[legacy.Version] = true
+	}
+	return adopted, nil
+}
+
+// Down reverts the given number of most recently applied migrations and
+// returns the reverted ones
+func (migrator *Migrator) Down(steps int) ([]Migration, error) {
+	reverted := []Migration{}
+	err := migrator.withLock(func(conn *sql.Conn, current map[int]bool) error {
+		for i := len(migrator.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := migrator.migrations[i]
+			if !current[migration.Version] {
+				continue
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("Migration %d_%s can't be reverted", migration.Version, migration.Name)
+			}
+
+			err := execStatements(conn, migration.Down)
+			if err != nil {
+				return fmt.Errorf("Reverting migration %d_%s failed: %s", migration.Version, migration.Name, err)
+			}
+
+			_, err = conn.ExecContext(context.Background(), `
+			DELETE FROM schema_migrations
+			WHERE version = ?
+			`,
+				migration.Version,
+			)
+			if err != nil {
+				return err
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Status returns all known migrations and whether they have been applied
+func (migrator *Migrator) Status() ([]Migration, map[int]bool, error) {
+	var applied map[int]bool
+	err := migrator.withLock(func(conn *sql.Conn, current map[int]bool) error {
+		applied = current
+		return nil
+	})
+	return migrator.migrations, applied, err
+}
+
+// withLock runs fn on a single connection while holding the migration lock,
+// passing the versions applied so far. The changes are rolled back if fn
+// fails, where the database supports it.
+func (migrator *Migrator) withLock(fn func(conn *sql.Conn, applied map[int]bool) error) (err error) {
+	ctx := context.Background()
+
+	// The lock belongs to the connection, so everything has to run on the
+	// same one
+	conn, err := migrator.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	unlock, err := migrator.db.Dialect.Lock(conn, migrationLockName, migrationLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		unlock(err == nil)
+	}()
+
+	_, err = conn.ExecContext(ctx, `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+	  version    INT          NOT NULL,
+	  name       VARCHAR(255) NOT NULL,
+	  applied_at DATETIME     NOT NULL,
+	  PRIMARY KEY (version)
+	)
+	`)
+	if err != nil {
+		return err
+	}
+
+	applied, err := appliedMigrations(conn)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn, applied)
+}
+
+// appliedMigrations returns the versions recorded in schema_migrations
+func appliedMigrations(conn *sql.Conn) (map[int]bool, error) {
+	rows, err := conn.QueryContext(context.Background(), "SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]bool{}
+	for rows.Next() {
+		var version int
+		err := rows.Scan(&version)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// execStatements runs the semicolon separated statements of a migration one
+// by one, as the driver doesn't accept multiple statements at once
+func execStatements(conn *sql.Conn, contents string) error {
+	for _, statement := range splitStatements(contents) {
+		_, err := conn.ExecContext(context.Background(), statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitStatements removes comment lines and splits the SQL at semicolons
+// ending a line
+func splitStatements(contents string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(contents, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "--") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	statements := []string{}
+	current := []string{}
+	for _, line := range lines {
+		current = append(current, line)
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			statements = appendStatement(statements, current)
+			current = nil
+		}
+	}
+	return appendStatement(statements, current)
+}
+
+func appendStatement(statements []string, lines []string) []string {
+	statement := strings.TrimSpace(strings.Join(lines, "\n"))
+	statement = strings.TrimSpace(strings.TrimSuffix(statement, ";"))
+	if statement == "" {
+		return statements
+	}
+	return append(statements, statement)
+}
+
+// RunMigrateCommand implements the "gophr migrate [up|down [steps]|status]"
+// subcommand and "gophr migrate import-users <file>", which copies the
+// users of a file user store into the database
+func RunMigrateCommand(db *DB, args []string) error {
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		applied, err := migrator.Up()
+		for _, migration := range applied {
+			fmt.Printf("Applied %d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("Database is up to date")
+		}
+		return err
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("Invalid number of steps %q", args[1])
+			}
+		}
+		reverted, err := migrator.Down(steps)
+		for _, migration := range reverted {
+			fmt.Printf("Reverted %d_%s\n", migration.Version, migration.Name)
+		}
+		return err
+
+	case "import-users":
+		if len(args) != 2 {
+			return errors.New("Usage: gophr migrate import-users <file>")
+		}
+
+		// The users table has to exist
+		_, err := migrator.Up()
+		if err != nil {
+			return err
+		}
+
+		from, err := NewFileUserStore(args[1], nil)
+		if err != nil {
+			return err
+		}
+		imported, err := ImportUsers(from, NewDBUserStore(db, nil))
+		fmt.Printf("Imported %d users\n", imported)
+		return err
+
+	case "status":
+		migrations, applied, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		for _, migration := range migrations {
+			state := "pending"
+			if applied[migration.Version] {
+				state = "applied"
+			}
+			fmt.Printf("%-8s %d_%s\n", state, migration.Version, migration.Name)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Unknown migrate command %q, expected up, down, status or import-users", command)
+}
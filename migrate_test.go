@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMigratorAdoptsLegacyImagesTable(t *testing.T) {
+	db, err := NewSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The table as the original queries expected it
+	_, err = db.Exec(`
+	CREATE TABLE images (
+	  id          VARCHAR(32)  NOT NULL PRIMARY KEY,
+	  user_id     VARCHAR(32)  NOT NULL,
+	  name        VARCHAR(255) NOT NULL,
+	  location    VARCHAR(255) NOT NULL,
+	  description TEXT         NOT NULL,
+	  size        BIGINT       NOT NULL,
+	  created_at  DATETIME     NOT NULL
+	)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2021, 2, 18, 12, 0, 0, 0, time.UTC)
+	_, err = db.Exec(`
+	INSERT INTO images (id, user_id, name, location, description, size, created_at)
+	VALUES ('img_legacy', 'usr_1', 'gopher.png', 'img_legacy.png', 'An old gopher', 42, ?)
+	`,
+		created,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := migrator.Up()
+	if err != nil {
+		t.Fatalf("Up failed on a hand made images table: %s", err)
+	}
+	if len(applied) != len(migrator.migrations) {
+		t.Errorf("applied %d migrations, want all %d", len(applied), len(migrator.migrations))
+	}
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns, indexes, err := db.Dialect.TableSchema(conn, "images")
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, column := range []string{"mime_type", "width", "height", "variants"} {
+		if !columns[column] {
+			t.Errorf("column %s wasn't added", column)
+		}
+	}
+	for _, index := range []string{"images_created_at", "images_user_id_created_at"} {
+		if !indexes[index] {
+			t.Errorf("index %s wasn't added", index)
+		}
+	}
+
+	// The existing images can be read and new ones written
+	store := NewDBImageStore(db, nil)
+	image, err := store.Find("img_legacy")
+	if err != nil || image == nil {
+		t.Fatalf("Find = %v, %v", image, err)
+	}
+	if image.Description != "An old gopher" || image.Size != 42 || len(image.Variants) != 0 {
+		t.Errorf("Find = %+v", image)
+	}
+	err = store.Save(&Image{ID: "img_new", UserID: "usr_1", Location: "img_new.png", CreatedAt: created.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := store.FindAll(0, 10)
+	if err != nil || imageIDs(images) != "img_new img_legacy" {
+		t.Errorf("FindAll = %s, %v", imageIDs(images), err)
+	}
+
+	// Running the migrations again is a no-op
+	applied, err = migrator.Up()
+	if err != nil || len(applied) != 0 {
+		t.Errorf("second Up = %d migrations, %v, want none", len(applied), err)
+	}
+}
+
+func TestMigratorRollsBackFailedMigrations(t *testing.T) {
+	db, err := NewSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrator := &Migrator{
+		db: db,
+		migrations: []Migration{
+			{Version: 1, Name: "create_a", Up: "CREATE TABLE a (x INT);"},
+			{Version: 2, Name: "create_b", Up: "CREATE TABLE b (x INT);\nCREATE TABLE b (x INT);"},
+		},
+	}
+	_, err = migrator.Up()
+	if err == nil {
+		t.Fatal("Up succeeded with a broken migration")
+	}
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"a", "b", "schema_migrations"} {
+		columns, _, err := db.Dialect.TableSchema(conn, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(columns) > 0 {
+			t.Errorf("table %s was kept after the migrations failed", table)
+		}
+	}
+	conn.Close()
+
+	// Once the migration is fixed, all migrations apply cleanly
+	migrator.migrations[1].Up = "CREATE TABLE b (x INT);"
+	applied, err := migrator.Up()
+	if err != nil || len(applied) != 2 {
+		t.Errorf("Up after fixing the migration = %d migrations, %v, want 2", len(applied), err)
+	}
+}
@@ -0,0 +1,19 @@
+-- Databases whose images table was created by hand before there were
+-- migrations keep their table, the migrator adds the missing columns and
+-- indexes instead and records this migration as applied
+CREATE TABLE images (
+  id          VARCHAR(32)   NOT NULL,
+  user_id     VARCHAR(32)   NOT NULL,
+  name        VARCHAR(255)  NOT NULL DEFAULT '',
+  location    VARCHAR(255)  NOT NULL,
+  description TEXT          NOT NULL,
+  size        BIGINT        NOT NULL DEFAULT 0,
+  mime_type   VARCHAR(64)   NOT NULL DEFAULT '',
+  width       INT           NOT NULL DEFAULT 0,
+  height      INT           NOT NULL DEFAULT 0,
+  created_at  DATETIME(6)   NOT NULL,
+  variants    TEXT          NOT NULL,
+  PRIMARY KEY (id),
+  KEY images_created_at (created_at),
+  KEY images_user_id_created_at (user_id, created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
@@ -0,0 +1,12 @@
+-- Users are looked up by their case-folded username and email address
+CREATE TABLE users (
+  id              VARCHAR(32)  NOT NULL,
+  username        VARCHAR(255) NOT NULL,
+  username_folded VARCHAR(255) NOT NULL,
+  email           VARCHAR(255) NOT NULL,
+  email_folded    VARCHAR(255) NOT NULL,
+  hashed_password VARCHAR(255) NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY users_username_folded (username_folded),
+  UNIQUE KEY users_email_folded (email_folded)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
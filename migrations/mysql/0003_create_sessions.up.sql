@@ -0,0 +1,8 @@
+-- Expired sessions are removed by the session sweeper
+CREATE TABLE sessions (
+  id      VARCHAR(32) NOT NULL,
+  user_id VARCHAR(32) NOT NULL DEFAULT '',
+  expiry  DATETIME(6) NOT NULL,
+  PRIMARY KEY (id),
+  KEY sessions_expiry (expiry)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
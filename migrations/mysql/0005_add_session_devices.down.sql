@@ -0,0 +1,5 @@
+ALTER TABLE sessions
+  DROP KEY sessions_user_id,
+  DROP COLUMN last_seen,
+  DROP COLUMN ip,
+  DROP COLUMN user_agent;
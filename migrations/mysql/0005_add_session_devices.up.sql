@@ -0,0 +1,7 @@
+-- The device a session is used from, shown on the account's sessions page
+ALTER TABLE sessions
+  ADD COLUMN user_agent VARCHAR(255) NOT NULL DEFAULT '',
+  ADD COLUMN ip         VARCHAR(45)  NOT NULL DEFAULT '',
+  ADD COLUMN last_seen  DATETIME(6)  NOT NULL DEFAULT '1970-01-01 00:00:00',
+  ADD KEY sessions_user_id (user_id);
+UPDATE sessions SET last_seen = UTC_TIMESTAMP(6);
@@ -0,0 +1,3 @@
+ALTER TABLE sessions
+  DROP COLUMN persistent,
+  DROP COLUMN created_at;
@@ -0,0 +1,8 @@
+-- Sessions expire after a period of inactivity, but never later than a
+-- maximum lifetime after they were created. Persistent sessions are
+-- remembered by the browser beyond the browser session.
+ALTER TABLE sessions
+  ADD COLUMN created_at DATETIME(6) NOT NULL DEFAULT '1970-01-01 00:00:00',
+  ADD COLUMN persistent BOOLEAN     NOT NULL DEFAULT FALSE;
+-- Existing sessions were created with a persistent cookie
+UPDATE sessions SET created_at = UTC_TIMESTAMP(6), persistent = TRUE;
@@ -0,0 +1,20 @@
+-- Databases whose images table was created by hand before there were
+-- migrations keep their table, the migrator adds the missing columns and
+-- indexes instead and records this migration as applied
+CREATE TABLE images (
+  id          VARCHAR(32)  NOT NULL PRIMARY KEY,
+  user_id     VARCHAR(32)  NOT NULL,
+  name        VARCHAR(255) NOT NULL DEFAULT '',
+  location    VARCHAR(255) NOT NULL,
+  description TEXT         NOT NULL,
+  size        BIGINT       NOT NULL DEFAULT 0,
+  mime_type   VARCHAR(64)  NOT NULL DEFAULT '',
+  width       INTEGER      NOT NULL DEFAULT 0,
+  height      INTEGER      NOT NULL DEFAULT 0,
+  created_at  DATETIME     NOT NULL,
+  variants    TEXT         NOT NULL
+);
+
+CREATE INDEX images_created_at ON images (created_at);
+
+CREATE INDEX images_user_id_created_at ON images (user_id, created_at);
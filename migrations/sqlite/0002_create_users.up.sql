@@ -0,0 +1,13 @@
+-- Users are looked up by their case-folded username and email address
+CREATE TABLE users (
+  id              VARCHAR(32)  NOT NULL PRIMARY KEY,
+  username        VARCHAR(255) NOT NULL,
+  username_folded VARCHAR(255) NOT NULL,
+  email           VARCHAR(255) NOT NULL,
+  email_folded    VARCHAR(255) NOT NULL,
+  hashed_password VARCHAR(255) NOT NULL
+);
+
+CREATE UNIQUE INDEX users_username_folded ON users (username_folded);
+
+CREATE UNIQUE INDEX users_email_folded ON users (email_folded);
@@ -0,0 +1,8 @@
+-- Expired sessions are removed by the session sweeper
+CREATE TABLE sessions (
+  id      VARCHAR(32) NOT NULL PRIMARY KEY,
+  user_id VARCHAR(32) NOT NULL DEFAULT '',
+  expiry  DATETIME    NOT NULL
+);
+
+CREATE INDEX sessions_expiry ON sessions (expiry);
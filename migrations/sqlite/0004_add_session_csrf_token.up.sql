@@ -0,0 +1,3 @@
+-- Forms carry this token, which is checked against the session on every
+-- state changing request
+ALTER TABLE sessions ADD COLUMN csrf_token VARCHAR(64) NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+DROP INDEX sessions_user_id;
+ALTER TABLE sessions DROP COLUMN last_seen;
+ALTER TABLE sessions DROP COLUMN ip;
+ALTER TABLE sessions DROP COLUMN user_agent;
@@ -0,0 +1,7 @@
+-- The device a session is used from, shown on the account's sessions page
+ALTER TABLE sessions ADD COLUMN user_agent VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN ip VARCHAR(45) NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN last_seen DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';
+UPDATE sessions SET last_seen = CURRENT_TIMESTAMP;
+
+CREATE INDEX sessions_user_id ON sessions (user_id);
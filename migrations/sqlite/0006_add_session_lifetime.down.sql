@@ -0,0 +1,2 @@
+ALTER TABLE sessions DROP COLUMN persistent;
+ALTER TABLE sessions DROP COLUMN created_at;
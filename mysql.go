@@ -1,19 +1,110 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
-var globalMySQLDB *sql.DB
+// NewMySQLDB opens a connection to the given dsn, which may carry parameters
+// of its own. Updates report the number of matched instead of changed rows,
+// so an update of an unchanged row can be told apart from an update of a
+// missing one.
+func NewMySQLDB(dsn string) (*DB, error) {
+	dsn, err := mysqlDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
 
-// NewMySQLDB opens a connection to the given dsn
-func NewMySQLDB(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("mysql", dsn+"?parseTime=true")
+	db, err := sql.Open("mysql", dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	return db, db.Ping()
+	return &DB{
+		DB:      db,
+		Dialect: mysqlDialect{},
+	}, db.Ping()
+}
+
+// mysqlDSN adds the parameters the stores rely on to the dsn
+func mysqlDSN(dsn string) (string, error) {
+	config, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	config.ParseTime = true
+	config.ClientFoundRows = true
+	return config.FormatDSN(), nil
+}
+
+// mysqlDialect implements the Dialect interface for MySQL and MariaDB
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string {
+	return "mysql"
+}
+
+func (mysqlDialect) Replace(table string, columns ...string) string {
+	return replaceStatement("REPLACE", table, columns)
+}
+
+func (mysqlDialect) LimitOffset() string {
+	return "LIMIT ? OFFSET ?"
+}
+
+// Timestamp converts the time to UTC, which the driver assumes when reading
+// DATETIME columns
+func (mysqlDialect) Timestamp(t time.Time) time.Time {
+	return t.UTC()
+}
+
+func (mysqlDialect) IsDuplicateKeyError(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == 1062
+}
+
+func (mysqlDialect) TableSchema(conn *sql.Conn, table string) (map[string]bool, map[string]bool, error) {
+	columns, err := queryNames(conn, `
+	SELECT column_name
+	FROM information_schema.columns
+	WHERE table_schema = DATABASE() AND table_name = ?
+	`,
+		table,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	indexes, err := queryNames(conn, `
+	SELECT DISTINCT index_name
+	FROM information_schema.statistics
+	WHERE table_schema = DATABASE() AND table_name = ?
+	`,
+		table,
+	)
+	return columns, indexes, err
+}
+
+// Lock uses MySQL's named locks, which are released when the connection
+// is closed at the latest. MySQL commits schema changes implicitly, so they
+// can't be rolled back.
+func (mysqlDialect) Lock(conn *sql.Conn, name string, timeout time.Duration) (func(bool), error) {
+	ctx := context.Background()
+
+	var locked sql.NullInt64
+	err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", name, int(timeout/time.Second)).Scan(&locked)
+	if err != nil {
+		return nil, err
+	}
+	if locked.Int64 != 1 {
+		return nil, errors.New("Timed out waiting for lock " + name)
+	}
+
+	return func(bool) {
+		conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", name)
+	}, nil
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestMySQLDSN(t *testing.T) {
+	tests := []string{
+		"gophr:password@tcp(127.0.0.1:3306)/gophr",
+		"gophr:password@tcp(127.0.0.1:3306)/gophr?tls=skip-verify",
+		"gophr:password@tcp(db:3306)/gophr?charset=utf8mb4&parseTime=false",
+	}
+
+	for _, dsn := range tests {
+		got, err := mysqlDSN(dsn)
+		if err != nil {
+			t.Errorf("mysqlDSN(%q) failed: %s", dsn, err)
+			continue
+		}
+
+		config, err := mysql.ParseDSN(got)
+		if err != nil {
+			t.Errorf("mysqlDSN(%q) = %q, which doesn't parse: %s", dsn, got, err)
+			continue
+		}
+		if !config.ParseTime || !config.ClientFoundRows {
+			t.Errorf("mysqlDSN(%q) = %q, want parseTime and clientFoundRows", dsn, got)
+		}
+		if config.DBName != "gophr" || config.Passwd != "password" {
+			t.Errorf("mysqlDSN(%q) = %q, lost the database or password", dsn, got)
+		}
+	}
+	got, _ := mysqlDSN("gophr:password@tcp(127.0.0.1:3306)/gophr?tls=skip-verify")
+	if config, _ := mysql.ParseDSN(got); config.TLSConfig != "skip-verify" {
+		t.Errorf("mysqlDSN lost the tls parameter: %q", got)
+	}
+
+	_, err := mysqlDSN("gophr:password@tcp(127.0.0.1:3306)/gophr?parseTime=maybe")
+	if err == nil {
+		t.Error("mysqlDSN accepted an invalid parameter")
+	}
+}
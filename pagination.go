@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// Pagination describes the currently requested page of a listing
+type Pagination struct {
+	Path    string
+	Page    int
+	Size    int
+	HasMore bool
+}
+
+// NewPagination reads the requested page number from the "page" query
+// parameter, defaulting to the first page. Page numbers are capped, so the
+// offset of the page fits into 32 bits and can't overflow.
+func NewPagination(r *http.Request, size int) *Pagination {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	if maxPage := math.MaxInt32/size - 1; page > maxPage {
+		page = maxPage
+	}
+
+	return &Pagination{
+		Path: r.URL.Path,
+		Page: page,
+		Size: size,
+	}
+}
+
+// Offset returns the number of records preceding the current page
+func (p *Pagination) Offset() int {
+	return (p.Page - 1) * p.Size
+}
+
+// Limit returns the number of records to fetch for the current page. One
+// more record than fits on the page is requested, so we know if there's a
+// next page without having to count all records.
+func (p *Pagination) Limit() int {
+	return p.Size + 1
+}
+
+// Paginate cuts the fetched images down to the page size and records if
+// there are more images available
+func (p *Pagination) Paginate(images []Image) []Image {
+	p.HasMore = len(images) > p.Size
+	if p.HasMore {
+		images = images[:p.Size]
+	}
+	return images
+}
+
+// HasPrevious returns true if the current page isn't the first one
+func (p *Pagination) HasPrevious() bool {
+	return p.Page > 1
+}
+
+// NextURL returns the url of the next page
+func (p *Pagination) NextURL() string {
+	return p.pageURL(p.Page + 1)
+}
+
+// PreviousURL returns the url of the previous page
+func (p *Pagination) PreviousURL() string {
+	return p.pageURL(p.Page - 1)
+}
+
+func (p *Pagination) pageURL(page int) string {
+	if page <= 1 {
+		return p.Path
+	}
+	return fmt.Sprintf("%s?page=%d", p.Path, page)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewPagination(t *testing.T) {
+	tests := []struct {
+		query string
+		size  int
+		page  int
+	}{
+		{"", 25, 1},
+		{"?page=2", 25, 2},
+		{"?page=0", 25, 1},
+		{"?page=-3", 25, 1},
+		{"?page=abc", 25, 1},
+		{"?page=99999999999999999999", 25, 1},
+		{"?page=9223372036854775807", 25, math.MaxInt32/25 - 1},
+		{"?page=2147483647", 1000, math.MaxInt32/1000 - 1},
+		{"?page=9223372036854775807", 1, math.MaxInt32 - 1},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/"+test.query, nil)
+		p := NewPagination(r, test.size)
+		if p.Page != test.page {
+			t.Errorf("NewPagination(%s, %d).Page = %d, want %d", test.query, test.size, p.Page, test.page)
+		}
+
+		offset := p.Offset()
+		if offset < 0 || offset+p.Limit() > math.MaxInt32 {
+			t.Errorf("NewPagination(%s, %d) has offset %d and limit %d", test.query, test.size, offset, p.Limit())
+		}
+
+		// Pages past the end are empty
+		images, err := NewMemoryImageStore().FindAll(offset, p.Limit())
+		if err != nil || len(images) != 0 {
+			t.Errorf("FindAll(%d, %d) = %v, %v", offset, p.Limit(), images, err)
+		}
+	}
+}
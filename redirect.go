@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SafeRedirectPath returns target if it's a relative path on this site and
+// "/" otherwise. Absolute urls, protocol relative "//host" urls and anything
+// browsers might read as such are rejected, so user supplied next values
+// can't send visitors to another site.
+func SafeRedirectPath(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		return "/"
+	}
+
+	// Browsers treat backslashes like slashes and drop tabs and newlines,
+	// "/\host" or "/\t/host" would leave the site
+	for _, c := range target {
+		if c == '\\' || c < 0x20 || c == 0x7f {
+			return "/"
+		}
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return "/"
+	}
+	return u.String()
+}
+
+// Redirect sends the user to the local path target, falling back to "/" for
+// anything else. A non-empty flash message is merged into the target's query.
+func Redirect(w http.ResponseWriter, r *http.Request, target, flash string) {
+	u, _ := url.Parse(SafeRedirectPath(target))
+	if flash != "" {
+		query := u.Query()
+		query.Set("flash", flash)
+		u.RawQuery = query.Encode()
+	}
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSafeRedirectPath(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/images/new", "/images/new"},
+		{"/user/usr_1?page=2", "/user/usr_1?page=2"},
+		{"images/new", "/"},
+		{"//evil.com", "/"},
+		{"//evil.com/images/new", "/"},
+		{`/\evil.com`, "/"},
+		{"/\t/evil.com", "/"},
+		{"https://evil.com", "/"},
+		{"javascript:alert(1)", "/"},
+		// Dot segments are resolved within the path, it stays on this site
+		{"/a/..//evil.com", "/a/..//evil.com"},
+	}
+
+	for _, test := range tests {
+		if got := SafeRedirectPath(test.target); got != test.want {
+			t.Errorf("SafeRedirectPath(%q) = %q, want %q", test.target, got, test.want)
+		}
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	tests := []struct {
+		target string
+		flash  string
+		want   string
+	}{
+		{"", "", "/"},
+		{"", "Signed in", "/?flash=Signed+in"},
+		{"/images/new", "", "/images/new"},
+		{"/images/new", "Signed in", "/images/new?flash=Signed+in"},
+		{"/user/usr_1?page=2", "Signed in", "/user/usr_1?flash=Signed+in&page=2"},
+		{"/?flash=Old", "New", "/?flash=New"},
+		{"//evil.com", "Signed in", "/?flash=Signed+in"},
+		{`/\evil.com`, "", "/"},
+		{"https://evil.com/?next=/", "", "/"},
+		// http.Redirect cleans the path, which mustn't turn it into "//evil.com"
+		{"/a/..//evil.com", "", "/evil.com"},
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		Redirect(recorder, httptest.NewRequest("POST", "/login", nil), test.target, test.flash)
+		if location := recorder.Header().Get("Location"); location != test.want {
+			t.Errorf("Redirect(%q, %q) to %q, want %q", test.target, test.flash, location, test.want)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config holds the connection settings of an S3 compatible object storage
+type S3Config struct {
+	// Endpoint is the base url of the service, e.g. https://s3.eu-central-1.amazonaws.com
+	// or http://localhost:9000 for a local MinIO server
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+}
+
+// S3BlobStore is an S3 compatible implementation of the BlobStore interface.
+// Objects are addressed path-style, which is understood by AWS as well as
+// MinIO and most other S3 compatible services.
+type S3BlobStore struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3TimeFormat      = "20060102T150405Z"
+	s3DateFormat      = "20060102"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3MaxSignedExpiry = 7 * 24 * time.Hour
+)
+
+// NewS3BlobStore returns an S3BlobStore for the configured bucket
+func NewS3BlobStore(config S3Config) (*S3BlobStore, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.New("The s3 blob store requires an endpoint and a bucket")
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+
+	region := config.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &S3BlobStore{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    config.Bucket,
+		accessKey: config.AccessKey,
+		secretKey: config.SecretKey,
+		client: &http.Client{
+			Timeout: 60 * time.Second,
+		},
+	}, nil
+}
+
+// Put uploads the blob as an object to the bucket
+func (store *S3BlobStore) Put(key string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	request, err := store.newRequest("PUT", key, data)
+	if err != nil {
+		return err
+	}
+	if contentType := mime.TypeByExtension(filepath.Ext(key)); contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	response, err := store.do(request)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// Get returns a reader for the object, which loads the object lazily and
+// seeks by issuing range requests
+func (store *S3BlobStore) Get(key string) (io.ReadSeekCloser, error) {
+	info, err := store.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Object{
+		store: store,
+		key:   key,
+		size:  info.Size,
+	}, nil
+}
+
+// Delete removes the object from the bucket
+func (store *S3BlobStore) Delete(key string) error {
+	request, err := store.newRequest("DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := store.do(request)
+	if err == errBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+// Stat returns the metadata of the object or errBlobNotFound
+func (store *S3BlobStore) Stat(key string) (*BlobInfo, error) {
+	request, err := store.newRequest("HEAD", key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := store.do(request)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+
+	modTime, _ := http.ParseTime(response.Header.Get("Last-Modified"))
+	return &BlobInfo{
+		Key:         key,
+		Size:        response.ContentLength,
+		ContentType: response.Header.Get("Content-Type"),
+		ModTime:     modTime,
+	}, nil
+}
+
+// SignedURL returns a presigned url granting read access to the object
+// until the expiry has passed
+func (store *S3BlobStore) SignedURL(key string, expiry time.Duration) (string, error) {
+	if expiry <= 0 || expiry > s3MaxSignedExpiry {
+		return "", fmt.Errorf("Signed url expiry must be between 1s and %s", s3MaxSignedExpiry)
+	}
+
+	return store.presign(store.objectURL(key), expiry, time.Now().UTC()), nil
+}
+
+// presign adds the query based signature of a GET request valid from now
+// until the expiry has passed to the url and returns it
+func (store *S3BlobStore) presign(objectURL *url.URL, expiry time.Duration, now time.Time) string {
+	query := objectURL.Query()
+	query.Set("X-Amz-Algorithm", s3Algorithm)
+	query.Set("X-Amz-Credential", store.accessKey+"/"+store.scope(now))
+	query.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expiry/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	objectURL.RawQuery = canonicalQuery(query)
+
+	header := http.Header{}
+	header.Set("Host", objectURL.Host)
+	signature := store.signature("GET", objectURL, header, s3UnsignedPayload, now)
+
+	objectURL.RawQuery += "&X-Amz-Signature=" + signature
+	return objectURL.String()
+}
+
+// newRequest creates a request for the object signed with the header based
+// signature
+func (store *S3BlobStore) newRequest(method, key string, body []byte) (*http.Request, error) {
+	objectURL := store.objectURL(key)
+	request, err := http.NewRequest(method, objectURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	store.sign(request, sha256Hex(body), time.Now().UTC())
+	return request, nil
+}
+
+// sign adds the header based signature of the request with the given
+// payload hash created at now
+func (store *S3BlobStore) sign(request *http.Request, payloadHash string, now time.Time) {
+	request.Header.Set("Host", request.URL.Host)
+	request.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signature := store.signature(request.Method, request.URL, request.Header, payloadHash, now)
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm,
+		store.accessKey,
+		store.scope(now),
+		signedHeaders(request.Header),
+		signature,
+	))
+}
+
+// do sends the request and turns unsuccessful responses into errors
+func (store *S3BlobStore) do(request *http.Request) (*http.Response, error) {
+	response, err := store.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode == http.StatusNotFound {
+		response.Body.Close()
+		return nil, errBlobNotFound
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		return nil, fmt.Errorf("s3: %s %s failed with %s: %s",
+			request.Method, request.URL.Path, response.Status, message)
+	}
+	return response, nil
+}
+
+// objectURL returns the path-style url of the object
+func (store *S3BlobStore) objectURL(key string) *url.URL {
+	objectURL := *store.endpoint
+	objectURL.Path = objectURL.Path + "/" + store.bucket + "/" + key
+	objectURL.RawPath = ""
+	objectURL.RawQuery = ""
+	return &objectURL
+}
+
+// scope returns the credential scope of a signature created at the given time
+func (store *S3BlobStore) scope(t time.Time) string {
+	return t.Format(s3DateFormat) + "/" + store.region + "/s3/aws4_request"
+}
+
+// signature calculates the AWS signature version 4 of the request
+func (store *S3BlobStore) signature(method string, requestURL *url.URL, header http.Header, payloadHash string, t time.Time) string {
+	canonicalRequest := strings.Join([]string{
+		method,
+		uriEncode(requestURL.Path, false),
+		canonicalQuery(requestURL.Query()),
+		canonicalHeaders(header),
+		signedHeaders(header),
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		t.Format(s3TimeFormat),
+		store.scope(t),
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+store.secretKey), t.Format(s3DateFormat))
+	key = hmacSHA256(key, store.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// canonicalQuery encodes the query sorted by key as required by the signature
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// canonicalHeaders lists the signed headers in lower case, sorted by name
+func canonicalHeaders(header http.Header) string {
+	var builder strings.Builder
+	for _, name := range signedHeaderNames(header) {
+		builder.WriteString(name)
+		builder.WriteString(":")
+		builder.WriteString(strings.TrimSpace(header.Get(name)))
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+// signedHeaders returns the names of the signed headers
+func signedHeaders(header http.Header) string {
+	return strings.Join(signedHeaderNames(header), ";")
+}
+
+// signedHeaderNames returns the sorted lower case names of the host and
+// x-amz-* headers, which are the headers included in the signature
+func signedHeaderNames(header http.Header) []string {
+	names := []string{}
+	for name := range header {
+		name = strings.ToLower(name)
+		if name == "host" || strings.HasPrefix(name, "x-amz-") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// uriEncode percent-encodes everything but the unreserved characters, slashes
+// are kept as is unless encodeSlash is set
+func uriEncode(value string, encodeSlash bool) string {
+	var builder strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			builder.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			builder.WriteByte(b)
+		default:
+			fmt.Fprintf(&builder, "%%%02X", b)
+		}
+	}
+	return builder.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Object reads an object on demand. Every read after a seek starts a new
+// range request at the current offset.
+type s3Object struct {
+	store  *S3BlobStore
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (object *s3Object) Read(p []byte) (int, error) {
+	if object.offset >= object.size {
+		return 0, io.EOF
+	}
+
+	if object.body == nil {
+		request, err := object.store.newRequest("GET", object.key, nil)
+		if err != nil {
+			return 0, err
+		}
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", object.offset))
+
+		response, err := object.store.do(request)
+		if err != nil {
+			return 0, err
+		}
+		object.body = response.Body
+	}
+
+	n, err := object.body.Read(p)
+	object.offset += int64(n)
+	return n, err
+}
+
+func (object *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += object.offset
+	case io.SeekEnd:
+		offset += object.size
+	default:
+		return 0, errors.New("s3: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+
+	if offset != object.offset && object.body != nil {
+		object.body.Close()
+		object.body = nil
+	}
+	object.offset = offset
+	return offset, nil
+}
+
+func (object *s3Object) Close() error {
+	if object.body == nil {
+		return nil
+	}
+	return object.body.Close()
+}
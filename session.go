@@ -1,52 +1,251 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
 // Session contains all Session account information
 type Session struct {
-	ID     string
-	UserID string
-	Expiry time.Time
+	ID        string
+	UserID    string
+	Expiry    time.Time
+	CSRFToken string
+
+	// The device the session is used from, as last seen
+	UserAgent string
+	IP        string
+	LastSeen  time.Time
+
+	CreatedAt time.Time
+	// Persistent sessions are remembered by the browser when it's closed
+	// and stay alive longer without activity
+	Persistent bool
 }
 
 const (
-	// Keep users logged in for 3 days
-	sessionLength     = 24 * 3 * time.Hour
 	sessionCookieName = "GophrSession"
 	sessionIDLength   = 20
+	// How often the device a session is used from is written to the store
+	sessionTouchInterval = time.Minute
+	// Longer user agents are cut off
+	maxUserAgentLength = 255
+)
+
+// contextKey is the type of the keys of values stored in the request context
+type contextKey int
+
+const (
+	sessionContextKey contextKey = iota
+	userContextKey
+	requestIDContextKey
+	requestRecordContextKey
 )
 
-// NewSession generates a new Session record and attaches corresponding login cookie
-func NewSession(w http.ResponseWriter) *Session {
-	expiry := time.Now().Add(sessionLength)
+// Minimum length of the secret signing the session cookies
+const minCookieSecretLength = 32
+
+var sameSiteModes = map[string]http.SameSite{
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// NewSession generates a new Session record for the request's device and
+// attaches corresponding login cookie. Persistent sessions get a cookie
+// which outlives the browser session.
+func (app *App) NewSession(w http.ResponseWriter, r *http.Request, persistent bool) *Session {
+	now := time.Now()
 	session := &Session{
-		ID:     GenerateID("sess", sessionIDLength),
-		Expiry: expiry,
+		ID:         GenerateID("sess", sessionIDLength),
+		CSRFToken:  generateCSRFToken(),
+		UserAgent:  requestUserAgent(r),
+		IP:         requestIP(r),
+		LastSeen:   now,
+		CreatedAt:  now,
+		Persistent: persistent,
+	}
+	app.extendSession(session, now)
+
+	app.setSessionCookie(w, session)
+	return session
+}
+
+// extendSession moves the session's expiry to the idle timeout after now,
+// but not beyond its maximum lifetime
+func (app *App) extendSession(session *Session, now time.Time) {
+	// Sessions stored before they had a creation time would be capped at a
+	// lifetime counted from year one, their lifetime starts now instead
+	if session.CreatedAt.IsZero() {
+		session.CreatedAt = now
 	}
 
-	cookie := http.Cookie{
-		Name:    sessionCookieName,
-		Value:   session.ID,
-		Expires: expiry,
+	session.Expiry = now.Add(app.sessionIdleTimeout(session))
+	maxExpiry := session.CreatedAt.Add(app.Config.SessionMaxLifetime)
+	if session.Expiry.After(maxExpiry) {
+		session.Expiry = maxExpiry
 	}
+}
 
-	http.SetCookie(w, &cookie)
-	return session
+// sessionIdleTimeout returns how long the session lasts without activity
+func (app *App) sessionIdleTimeout(session *Session) time.Duration {
+	if session.Persistent {
+		return app.Config.SessionLength
+	}
+	return app.Config.SessionIdleTimeout
+}
+
+// RotateSession replaces the request's session with a new one for the user,
+// so a session ID known before signing in, changing the password or any
+// other change of privileges is worthless afterwards. The returned request
+// carries the new session.
+func (app *App) RotateSession(w http.ResponseWriter, r *http.Request, user *User, persistent bool) (*Session, *http.Request) {
+	old := RequestSession(r)
+	if old != nil {
+		err := app.Sessions.Delete(old)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	session := app.NewSession(w, r, persistent)
+	session.UserID = user.ID
+	err := app.Sessions.Save(session)
+	if err != nil {
+		panic(err)
+	}
+	return session, withSession(r, session, user)
+}
+
+// setSessionCookie sends the session cookie with the configured attributes.
+// Only persistent sessions set an expiry, all others end with the browser
+// session.
+func (app *App) setSessionCookie(w http.ResponseWriter, session *Session) {
+	config := app.Config.SessionCookie
+	cookie := &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    app.signSessionID(session.ID),
+		Path:     config.Path,
+		Secure:   config.Secure,
+		HttpOnly: config.HTTPOnly,
+		SameSite: sameSiteModes[config.SameSite],
+	}
+	if session.Persistent {
+		cookie.Expires = session.Expiry
+	}
+	http.SetCookie(w, cookie)
+}
+
+// clearSessionCookie tells the browser to delete the session cookie
+func (app *App) clearSessionCookie(w http.ResponseWriter) {
+	config := app.Config.SessionCookie
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     config.Path,
+		MaxAge:   -1,
+		Secure:   config.Secure,
+		HttpOnly: config.HTTPOnly,
+		SameSite: sameSiteModes[config.SameSite],
+	})
+}
+
+// signSessionID returns the cookie value of the session ID, which is
+// "<id>.<signature>" if a cookie secret is configured
+func (app *App) signSessionID(id string) string {
+	if app.Config.SessionCookie.Secret == "" {
+		return id
+	}
+	return id + "." + app.sessionIDSignature(id)
+}
+
+// verifySessionID returns the session ID of a cookie value or false if the
+// value's signature is missing or wrong
+func (app *App) verifySessionID(value string) (string, bool) {
+	if app.Config.SessionCookie.Secret == "" {
+		return value, true
+	}
+
+	dot := strings.LastIndexByte(value, '.')
+	if dot < 0 {
+		return "", false
+	}
+	id, signature := value[:dot], value[dot+1:]
+	if !hmac.Equal([]byte(signature), []byte(app.sessionIDSignature(id))) {
+		return "", false
+	}
+	return id, true
+}
+
+func (app *App) sessionIDSignature(id string) string {
+	mac := hmac.New(sha256.New, []byte(app.Config.SessionCookie.Secret))
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// PublicID returns a handle of the session which is safe to show in pages.
+// It can't be turned back into the session ID, which works as a cookie.
+func (session *Session) PublicID() string {
+	sum := sha256.Sum256([]byte("session:" + session.ID))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
 }
 
-// RequestSession retrieves the Session from a http Request cookie or returns nil
+// Expired checks the expiry date and returns true if the session timeoout
+// has been reached
+func (session *Session) Expired() bool {
+	return session.Expiry.Before(time.Now())
+}
+
+// Authenticate is a middleware which loads the Session from the request's
+// cookie and its User from the stores once, and stores both in the request
+// context for RequestSession and RequestUser
+func (app *App) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := app.loadSession(r)
+		if session != nil {
+			app.touchSession(w, r, session)
+		}
+
+		var user *User
+		if session != nil && session.UserID != "" {
+			var err error
+			user, err = app.Users.Find(session.UserID)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		if record := requestRecordOf(r); record != nil && user != nil {
+			record.UserID = user.ID
+		}
+
+		next.ServeHTTP(w, withSession(r, session, user))
+	})
+}
+
+// loadSession retrieves the Session from a http Request cookie or returns nil
 // if not found
-func RequestSession(r *http.Request) *Session {
+func (app *App) loadSession(r *http.Request) *Session {
 	cookie, err := r.Cookie(sessionCookieName)
 	if err != nil {
 		return nil
 	}
 
-	session, err := globalSessionStore.Find(cookie.Value)
+	// forged or tampered cookies never reach the store
+	id, ok := app.verifySessionID(cookie.Value)
+	if !ok {
+		app.Logger.Info("session cookie signature rejected", "request_id", RequestID(r))
+		return nil
+	}
+
+	session, err := app.Sessions.Find(id)
 	if err != nil {
 		panic(err)
 	}
@@ -58,54 +257,105 @@ func RequestSession(r *http.Request) *Session {
 
 	// delete session from store if it has expired
 	if session.Expired() {
-		globalSessionStore.Delete(session)
+		app.Sessions.Delete(session)
 		return nil
 	}
 	return session
 }
 
-// Expired checks the expiry date and returns true if the session timeoout
-// has been reached
-func (session *Session) Expired() bool {
-	return session.Expiry.Before(time.Now())
-}
+// touchSession records the device the session is used from and when it was
+// last seen, and slides its expiry forward. The store is only written when
+// the device changed or a minute has passed, not on every request. Short
+// idle timeouts are refreshed at least twice per timeout.
+func (app *App) touchSession(w http.ResponseWriter, r *http.Request, session *Session) {
+	now := time.Now()
+	userAgent := requestUserAgent(r)
+	ip := requestIP(r)
 
-// RequestUser retrieves the User from a http Request cookie or returns nil
-// if not found
-func RequestUser(r *http.Request) *User {
-	session := RequestSession(r)
-	if session == nil || session.UserID == "" {
-		return nil
+	interval := sessionTouchInterval
+	if idleTimeout := app.sessionIdleTimeout(session); idleTimeout/2 < interval {
+		interval = idleTimeout / 2
+	}
+	if now.Sub(session.LastSeen) < interval &&
+		session.UserAgent == userAgent && session.IP == ip {
+		return
 	}
 
-	user, err := globalUserStore.Find(session.UserID)
+	session.LastSeen = now
+	session.UserAgent = userAgent
+	session.IP = ip
+	app.extendSession(session, now)
+	err := app.Sessions.Save(session)
 	if err != nil {
 		panic(err)
 	}
 
-	return user
+	// the browser has to keep a persistent cookie until the new expiry
+	if session.Persistent {
+		app.setSessionCookie(w, session)
+	}
 }
 
-// RequireLogin checks if RequestUser returns a valid user or if not set's the
-// next entry to the requested url and redirects to the login page
-func RequireLogin(w http.ResponseWriter, r *http.Request) {
-	// pass if user is found
-	if RequestUser(r) != nil {
-		return
+// requestIP returns the IP address of the client
+func requestIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
+	return host
+}
 
-	query := url.Values{}
-	query.Add("next", url.QueryEscape(r.URL.String()))
+// requestUserAgent returns the client's user agent, cut to the length the
+// stores keep
+func requestUserAgent(r *http.Request) string {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+	}
+	return userAgent
+}
 
-	http.Redirect(w, r, "/login?"+query.Encode(), http.StatusFound)
+// withSession returns a copy of the request carrying the session and user
+// in its context
+func withSession(r *http.Request, session *Session, user *User) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionContextKey, session)
+	ctx = context.WithValue(ctx, userContextKey, user)
+	return r.WithContext(ctx)
 }
 
-// FindOrCreateSession looks for an already existing session for this user or
-// create a new session if none is found
-func FindOrCreateSession(w http.ResponseWriter, r *http.Request) *Session {
-	session := RequestSession(r)
-	if session == nil {
-		session = NewSession(w)
-	}
+// RequestSession returns the Session loaded by Authenticate or nil if the
+// request doesn't belong to a session
+func RequestSession(r *http.Request) *Session {
+	session, _ := r.Context().Value(sessionContextKey).(*Session)
 	return session
 }
+
+// RequestUser returns the User loaded by Authenticate or nil if the request
+// isn't signed in
+func RequestUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey).(*User)
+	return user
+}
+
+// RequireLogin is a middleware which only passes requests of signed in users.
+// Everyone else is redirected to the login page with the next entry set to
+// the requested url. Only GET requests can be repeated after signing in,
+// other methods come back to the home page.
+func (app *App) RequireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// pass if user is found
+		if RequestUser(r) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		target := "/login"
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			query := url.Values{}
+			query.Set("next", r.URL.RequestURI())
+			target += "?" + query.Encode()
+		}
+
+		Redirect(w, r, target, "")
+	})
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"database/sql"
 	"io/ioutil"
 	"os"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/go-yaml/yaml"
 )
@@ -13,23 +17,37 @@ type SessionStore interface {
 	Find(string) (*Session, error)
 	Save(*Session) error
 	Delete(*Session) error
+	// FindAllByUser returns the user's sessions, most recently seen first
+	FindAllByUser(userID string) ([]Session, error)
+	// DeleteAllByUser removes all sessions of the user except the one with
+	// the given id and returns the number of deleted sessions
+	DeleteAllByUser(userID, exceptID string) (int64, error)
 }
 
-// global list of server sessions
-var globalSessionStore SessionStore
+// ActiveSessionCounter is implemented by session stores which are able to
+// count the sessions which haven't expired yet
+type ActiveSessionCounter interface {
+	// CountActive returns the number of sessions not expired at the given
+	// time and the number of distinct users they belong to
+	CountActive(now time.Time) (sessions, users int64, err error)
+}
 
-// FileSessionStore is a file based implementation of the SessionStore interface
+// FileSessionStore is a file based implementation of the SessionStore
+// interface, which is safe for concurrent use
 type FileSessionStore struct {
+	mutex    sync.RWMutex
 	filename string
+	logger   *Logger
 	Sessions map[string]Session
 }
 
 // NewFileSessionStore loads the SessionStore from file or returns a new one
 // if the file doesn't exist
-func NewFileSessionStore(name string) (*FileSessionStore, error) {
+func NewFileSessionStore(name string, logger *Logger) (*FileSessionStore, error) {
 	store := &FileSessionStore{
 		Sessions: map[string]Session{},
 		filename: name,
+		logger:   logger,
 	}
 
 	contents, err := ioutil.ReadFile(name)
@@ -37,6 +55,7 @@ func NewFileSessionStore(name string) (*FileSessionStore, error) {
 	if err != nil {
 		// If it's a matter of the file not existing, that's ok
 		if os.IsNotExist(err) {
+			logger.Info("session file not found, starting empty", "file", name)
 			return store, nil
 		}
 		return nil, err
@@ -45,11 +64,15 @@ func NewFileSessionStore(name string) (*FileSessionStore, error) {
 	if err != nil {
 		return nil, err
 	}
+	logger.Info("sessions loaded", "file", name, "count", len(store.Sessions))
 	return store, err
 }
 
 // Find returns the Session with the given id or nil if not found
 func (store *FileSessionStore) Find(id string) (*Session, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
 	session, exists := store.Sessions[id]
 	if !exists {
 		return nil, nil
@@ -60,23 +83,387 @@ func (store *FileSessionStore) Find(id string) (*Session, error) {
 
 // Save stores the Session in a yaml file
 func (store *FileSessionStore) Save(session *Session) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
 	store.Sessions[session.ID] = *session
+	store.logger.Debug("session saved", "session_id", session.ID, "user_id", session.UserID)
+	return store.write()
+}
+
+// Delete removes a Session from the store
+func (store *FileSessionStore) Delete(session *Session) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.Sessions, session.ID)
+	store.logger.Debug("session deleted", "session_id", session.ID)
+	return store.write()
+}
+
+// FindAllByUser returns the user's sessions, most recently seen first
+func (store *FileSessionStore) FindAllByUser(userID string) ([]Session, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return sessionsOfUser(store.Sessions, userID), nil
+}
+
+// DeleteAllByUser removes all sessions of the user except the one with the
+// given id and returns the number of deleted sessions
+func (store *FileSessionStore) DeleteAllByUser(userID, exceptID string) (int64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	deleted := deleteSessionsOfUser(store.Sessions, userID, exceptID)
+	if deleted == 0 {
+		return 0, nil
+	}
+	store.logger.Debug("user sessions deleted", "user_id", userID, "count", deleted)
+	return deleted, store.write()
+}
+
+// DeleteExpired removes all sessions which expired before the given time and
+// returns the number of deleted sessions
+func (store *FileSessionStore) DeleteExpired(before time.Time) (int64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var deleted int64
+	for id, session := range store.Sessions {
+		if session.Expiry.Before(before) {
+			delete(store.Sessions, id)
+			deleted++
+		}
+	}
+	if deleted == 0 {
+		return 0, nil
+	}
+
+	return deleted, store.write()
+}
+
+// CountActive returns the number of sessions not expired at the given time
+// and the number of distinct users they belong to
+func (store *FileSessionStore) CountActive(now time.Time) (int64, int64, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return countActiveSessions(store.Sessions, now)
+}
+
+// write saves all sessions to the yaml file, the caller has to hold the lock
+func (store *FileSessionStore) write() error {
 	//	contents, err := json.MarshalIndent(store, "", "  ")
 	contents, err := yaml.Marshal(store)
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(store.filename, contents, 0660)
+	return writeFileAtomic(store.filename, contents, 0660)
 }
 
-// Delete removes a Session from the store
-func (store *FileSessionStore) Delete(session *Session) error {
-	delete(store.Sessions, session.ID)
-	contents, err := yaml.Marshal(store)
+// DBSessionStore is a database implementation of the SessionStore interface
+type DBSessionStore struct {
+	db     *DB
+	logger *Logger
+}
+
+// NewDBSessionStore returns a newly created DBSessionStore on the given database
+func NewDBSessionStore(db *DB, logger *Logger) *DBSessionStore {
+	return &DBSessionStore{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// Find returns the Session with the given id or nil if not found
+func (store *DBSessionStore) Find(id string) (*Session, error) {
+	row := store.db.QueryRow(`
+	SELECT `+sessionColumns+`
+	FROM sessions
+	WHERE id = ?
+	`,
+		id,
+	)
+
+	session, err := scanSession(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// The columns scanSession expects
+const sessionColumns = "id, user_id, expiry, csrf_token, user_agent, ip, last_seen, created_at, persistent"
+
+// scanSession reads a Session from a row of sessionColumns
+func scanSession(row interface{ Scan(...interface{}) error }) (*Session, error) {
+	session := Session{}
+	err := row.Scan(
+		&session.ID,
+		&session.UserID,
+		&session.Expiry,
+		&session.CSRFToken,
+		&session.UserAgent,
+		&session.IP,
+		&session.LastSeen,
+		&session.CreatedAt,
+		&session.Persistent,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Save stores the Session in the database
+func (store *DBSessionStore) Save(session *Session) error {
+	_, err := store.db.Exec(store.db.Dialect.Replace("sessions",
+		"id", "user_id", "expiry", "csrf_token", "user_agent", "ip", "last_seen", "created_at", "persistent",
+	),
+		session.ID,
+		session.UserID,
+		store.db.Dialect.Timestamp(session.Expiry),
+		session.CSRFToken,
+		session.UserAgent,
+		session.IP,
+		store.db.Dialect.Timestamp(session.LastSeen),
+		store.db.Dialect.Timestamp(session.CreatedAt),
+		session.Persistent,
+	)
 	if err != nil {
 		return err
 	}
+	store.logger.Debug("session saved", "session_id", session.ID, "user_id", session.UserID)
+	return nil
+}
+
+// Delete removes a Session from the database
+func (store *DBSessionStore) Delete(session *Session) error {
+	_, err := store.db.Exec(`
+	DELETE FROM sessions
+	WHERE id = ?
+	`,
+		session.ID,
+	)
+	if err != nil {
+		return err
+	}
+	store.logger.Debug("session deleted", "session_id", session.ID)
+	return nil
+}
+
+// FindAllByUser returns the user's sessions, most recently seen first
+func (store *DBSessionStore) FindAllByUser(userID string) ([]Session, error) {
+	rows, err := store.db.Query(`
+	SELECT `+sessionColumns+`
+	FROM sessions
+	WHERE user_id = ?
+	ORDER BY last_seen DESC
+	`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	return ioutil.WriteFile(store.filename, contents, 0660)
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteAllByUser removes all sessions of the user except the one with the
+// given id and returns the number of deleted sessions
+func (store *DBSessionStore) DeleteAllByUser(userID, exceptID string) (int64, error) {
+	result, err := store.db.Exec(`
+	DELETE FROM sessions
+	WHERE user_id = ? AND id <> ?
+	`,
+		userID,
+		exceptID,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	store.logger.Debug("user sessions deleted", "user_id", userID, "count", deleted)
+	return deleted, nil
+}
+
+// DeleteExpired removes all sessions which expired before the given time and
+// returns the number of deleted sessions
+func (store *DBSessionStore) DeleteExpired(before time.Time) (int64, error) {
+	result, err := store.db.Exec(`
+	DELETE FROM sessions
+	WHERE expiry < ?
+	`,
+		store.db.Dialect.Timestamp(before),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// CountActive returns the number of sessions not expired at the given time
+// and the number of distinct users they belong to. Anonymous sessions have
+// no user.
+func (store *DBSessionStore) CountActive(now time.Time) (int64, int64, error) {
+	row := store.db.QueryRow(`
+	SELECT COUNT(*), COUNT(DISTINCT NULLIF(user_id, ''))
+	FROM sessions
+	WHERE expiry >= ?
+	`,
+		store.db.Dialect.Timestamp(now),
+	)
+
+	var sessions, users int64
+	err := row.Scan(&sessions, &users)
+	return sessions, users, err
+}
+
+// MemorySessionStore is an in-memory implementation of the SessionStore
+// interface, which is safe for concurrent use. It's meant for tests and
+// development.
+type MemorySessionStore struct {
+	mutex    sync.RWMutex
+	sessions map[string]Session
+}
+
+// NewMemorySessionStore returns an empty MemorySessionStore
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: map[string]Session{},
+	}
+}
+
+// Find returns the Session with the given id or nil if not found
+func (store *MemorySessionStore) Find(id string) (*Session, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	session, exists := store.sessions[id]
+	if !exists {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+// Save stores the Session in memory
+func (store *MemorySessionStore) Save(session *Session) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.sessions[session.ID] = *session
+	return nil
+}
+
+// Delete removes a Session from the store
+func (store *MemorySessionStore) Delete(session *Session) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.sessions, session.ID)
+	return nil
+}
+
+// FindAllByUser returns the user's sessions, most recently seen first
+func (store *MemorySessionStore) FindAllByUser(userID string) ([]Session, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return sessionsOfUser(store.sessions, userID), nil
+}
+
+// DeleteAllByUser removes all sessions of the user except the one with the
+// given id and returns the number of deleted sessions
+func (store *MemorySessionStore) DeleteAllByUser(userID, exceptID string) (int64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return deleteSessionsOfUser(store.sessions, userID, exceptID), nil
+}
+
+// DeleteExpired removes all sessions which expired before the given time and
+// returns the number of deleted sessions
+func (store *MemorySessionStore) DeleteExpired(before time.Time) (int64, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	var deleted int64
+	for id, session := range store.sessions {
+		if session.Expiry.Before(before) {
+			delete(store.sessions, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// CountActive returns the number of sessions not expired at the given time
+// and the number of distinct users they belong to
+func (store *MemorySessionStore) CountActive(now time.Time) (int64, int64, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return countActiveSessions(store.sessions, now)
+}
+
+// countActiveSessions counts the sessions not expired at the given time and
+// their distinct users
+func countActiveSessions(sessions map[string]Session, now time.Time) (int64, int64, error) {
+	var count int64
+	users := map[string]bool{}
+	for _, session := range sessions {
+		if session.Expiry.Before(now) {
+			continue
+		}
+		count++
+		if session.UserID != "" {
+			users[session.UserID] = true
+		}
+	}
+	return count, int64(len(users)), nil
+}
+
+// sessionsOfUser returns the user's sessions, most recently seen first
+func sessionsOfUser(sessions map[string]Session, userID string) []Session {
+	found := []Session{}
+	for _, session := range sessions {
+		if session.UserID == userID {
+			found = append(found, session)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].LastSeen.After(found[j].LastSeen)
+	})
+	return found
+}
+
+// deleteSessionsOfUser removes the user's sessions except the one with the
+// given id and returns the number of deleted sessions
+func deleteSessionsOfUser(sessions map[string]Session, userID, exceptID string) int64 {
+	var deleted int64
+	for id, session := range sessions {
+		if session.UserID == userID && id != exceptID {
+			delete(sessions, id)
+			deleted++
+		}
+	}
+	return deleted
 }
@@ -0,0 +1,75 @@
+package main
+
+import "time"
+
+// How often expired sessions are removed from the store
+const sessionSweepInterval = 15 * time.Minute
+
+// ExpiredSessionDeleter is implemented by session stores which are able to
+// remove all expired sessions at once
+type ExpiredSessionDeleter interface {
+	DeleteExpired(before time.Time) (int64, error)
+}
+
+// SessionSweeper periodically deletes expired sessions in the background, so
+// they don't pile up in the store until someone presents them again
+type SessionSweeper struct {
+	store    ExpiredSessionDeleter
+	interval time.Duration
+	logger   *Logger
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewSessionSweeper returns a SessionSweeper for the store, which has to be
+// started with Start
+func NewSessionSweeper(store ExpiredSessionDeleter, interval time.Duration, logger *Logger) *SessionSweeper {
+	return &SessionSweeper{
+		store:    store,
+		interval: interval,
+		logger:   logger,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs the sweeper in its own goroutine until Stop is called
+func (sweeper *SessionSweeper) Start() {
+	go sweeper.run()
+}
+
+// Stop signals the sweeper to finish and waits until it has
+func (sweeper *SessionSweeper) Stop() {
+	close(sweeper.stop)
+	<-sweeper.done
+}
+
+func (sweeper *SessionSweeper) run() {
+	defer close(sweeper.done)
+
+	ticker := time.NewTicker(sweeper.interval)
+	defer ticker.Stop()
+
+	for {
+		// Sweep right away, the process may have been down for a while
+		sweeper.Sweep()
+
+		select {
+		case <-ticker.C:
+		case <-sweeper.stop:
+			return
+		}
+	}
+}
+
+// Sweep deletes all sessions which have expired by now
+func (sweeper *SessionSweeper) Sweep() {
+	deleted, err := sweeper.store.DeleteExpired(time.Now())
+	if err != nil {
+		sweeper.logger.Error("deleting expired sessions failed", "error", err)
+		return
+	}
+	if deleted > 0 {
+		sweeper.logger.Info("expired sessions deleted", "count", deleted)
+	}
+}
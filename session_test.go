@@ -0,0 +1,281 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExtendSession(t *testing.T) {
+	app := &App{Config: DefaultConfig()}
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	idle := app.Config.SessionIdleTimeout
+	lifetime := app.Config.SessionMaxLifetime
+
+	tests := []struct {
+		name       string
+		createdAt  time.Time
+		persistent bool
+		want       time.Time
+	}{
+		{"new session", now, false, now.Add(idle)},
+		{"new persistent session", now, true, now.Add(app.Config.SessionLength)},
+		{"session close to its lifetime", now.Add(-lifetime + time.Hour), false, now.Add(time.Hour)},
+		{"session past its lifetime", now.Add(-lifetime - time.Hour), false, now.Add(-time.Hour)},
+		{"session without creation time", time.Time{}, false, now.Add(idle)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session := &Session{CreatedAt: test.createdAt, Persistent: test.persistent}
+			app.extendSession(session, now)
+			if !session.Expiry.Equal(test.want) {
+				t.Errorf("Expiry = %s, want %s", session.Expiry, test.want)
+			}
+			if session.CreatedAt.IsZero() {
+				t.Error("CreatedAt wasn't set")
+			}
+		})
+	}
+}
+
+// Sessions written before sessions had a creation time must stay signed in
+func TestTouchSessionWithoutCreationTime(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "sessions.yaml")
+	expiry := time.Now().Add(time.Hour).Format(time.RFC3339Nano)
+	err := ioutil.WriteFile(filename, []byte(`sessions:
+  sess_legacy:
+    id: sess_legacy
+    userid: usr_1
+    expiry: !!timestamp `+expiry+`
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := NewFileSessionStore(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := newTestApp(t, Stores{Sessions: sessions})
+	err = app.Users.Save(User{ID: "usr_1", Username: "gopher", Email: "gopher@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var user *User
+	handler := app.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = RequestUser(r)
+	}))
+	request := httptest.NewRequest("GET", "/", nil)
+	request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: app.signSessionID("sess_legacy")})
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	if user == nil || user.ID != "usr_1" {
+		t.Fatalf("RequestUser = %v, want usr_1", user)
+	}
+
+	session, err := sessions.Find("sess_legacy")
+	if err != nil || session == nil {
+		t.Fatalf("Find = %v, %v", session, err)
+	}
+	if session.CreatedAt.IsZero() {
+		t.Error("CreatedAt wasn't backfilled")
+	}
+	if !session.Expiry.After(time.Now()) {
+		t.Errorf("Expiry = %s, the session has expired", session.Expiry)
+	}
+}
+
+func TestVerifySessionID(t *testing.T) {
+	app := &App{Config: DefaultConfig()}
+	app.Config.SessionCookie.Secret = "secret"
+	signed := app.signSessionID("sess_1")
+
+	other := &App{Config: DefaultConfig()}
+	other.Config.SessionCookie.Secret = "other secret"
+
+	tests := []struct {
+		name  string
+		value string
+		want  bool
+	}{
+		{"signed", signed, true},
+		{"unsigned", "sess_1", false},
+		{"empty", "", false},
+		{"empty signature", "sess_1.", false},
+		{"forged signature", "sess_1.AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA", false},
+		{"signature of another id", "sess_2" + strings.TrimPrefix(signed, "sess_1"), false},
+		{"signed with another secret", other.signSessionID("sess_1"), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id, ok := app.verifySessionID(test.value)
+			if ok != test.want || (ok && id != "sess_1") {
+				t.Errorf("verifySessionID(%q) = %q, %v, want %v", test.value, id, ok, test.want)
+			}
+		})
+	}
+
+	// Without a secret the cookie value is the session ID
+	other.Config.SessionCookie.Secret = ""
+	if id, ok := other.verifySessionID("sess_1"); !ok || id != "sess_1" {
+		t.Errorf("verifySessionID without a secret = %q, %v, want sess_1, true", id, ok)
+	}
+}
+
+// A session ID taken from elsewhere doesn't sign anybody in without the
+// cookie's signature
+func TestUnsignedSessionCookie(t *testing.T) {
+	app := newSessionTestApp(t)
+
+	for _, value := range []string{"sess_current", "sess_current.forged", app.signSessionID("sess_current")} {
+		request := httptest.NewRequest("GET", "/account/sessions", nil)
+		request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: value})
+		recorder := httptest.NewRecorder()
+		app.ServeHTTP(recorder, request)
+
+		signedIn := recorder.Code == http.StatusOK
+		if want := value == app.signSessionID("sess_current"); signedIn != want {
+			t.Errorf("cookie %q: status = %d, signed in = %v, want %v", value, recorder.Code, signedIn, want)
+		}
+	}
+}
+
+// newSessionTestApp returns an app signing its cookies with the sessions of
+// two users, gopher is signed in on three devices and other on one
+func newSessionTestApp(t *testing.T) *App {
+	t.Helper()
+
+	app := newTestApp(t, Stores{})
+	app.Config.SessionCookie.Secret = "secret"
+
+	for _, user := range []User{
+		{ID: "usr_gopher", Username: "gopher", Email: "gopher@example.com"},
+		{ID: "usr_other", Username: "other", Email: "other@example.com"},
+	} {
+		err := app.Users.Save(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for id, userID := range map[string]string{
+		"sess_current": "usr_gopher",
+		"sess_phone":   "usr_gopher",
+		"sess_laptop":  "usr_gopher",
+		"sess_other":   "usr_other",
+	} {
+		session := &Session{ID: id, UserID: userID, CSRFToken: "token_" + id, LastSeen: time.Now()}
+		app.extendSession(session, time.Now())
+		err := app.Sessions.Save(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return app
+}
+
+// postAs submits the form with the cookie and CSRF token of the session
+func postAs(t *testing.T, app *App, sessionID, path string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	form.Set(csrfFieldName, "token_"+sessionID)
+	request := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: app.signSessionID(sessionID)})
+	recorder := httptest.NewRecorder()
+	app.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// expectSessions fails unless exactly the given sessions are left
+func expectSessions(t *testing.T, app *App, want ...string) {
+	t.Helper()
+
+	left := map[string]bool{}
+	for _, id := range []string{"sess_current", "sess_phone", "sess_laptop", "sess_other"} {
+		session, err := app.Sessions.Find(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		left[id] = session != nil
+	}
+	for id := range left {
+		wanted := false
+		for _, wantID := range want {
+			wanted = wanted || wantID == id
+		}
+		if left[id] != wanted {
+			t.Errorf("session %s exists = %v, want %v", id, left[id], wanted)
+		}
+	}
+}
+
+func TestHandleSessionRevoke(t *testing.T) {
+	publicID := func(id string) string {
+		return (&Session{ID: id}).PublicID()
+	}
+
+	tests := []struct {
+		name     string
+		publicID string
+		status   int
+		location string
+		left     []string
+	}{
+		{"own device", publicID("sess_phone"), http.StatusFound,
+			"/account/sessions?flash=Device+signed+out", []string{"sess_current", "sess_laptop", "sess_other"}},
+		{"current device", publicID("sess_current"), http.StatusFound,
+			"/login?flash=Signed+out", []string{"sess_phone", "sess_laptop", "sess_other"}},
+		{"unknown public id", "nope", http.StatusNotFound,
+			"", []string{"sess_current", "sess_phone", "sess_laptop", "sess_other"}},
+		{"empty public id", "", http.StatusNotFound,
+			"", []string{"sess_current", "sess_phone", "sess_laptop", "sess_other"}},
+		{"session id instead of public id", "sess_phone", http.StatusNotFound,
+			"", []string{"sess_current", "sess_phone", "sess_laptop", "sess_other"}},
+		{"another user's device", publicID("sess_other"), http.StatusNotFound,
+			"", []string{"sess_current", "sess_phone", "sess_laptop", "sess_other"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app := newSessionTestApp(t)
+			response := postAs(t, app, "sess_current", "/account/sessions/revoke", url.Values{
+				"public_id": {test.publicID},
+			})
+			if response.Code != test.status {
+				t.Errorf("status = %d, want %d", response.Code, test.status)
+			}
+			if location := response.Header().Get("Location"); location != test.location {
+				t.Errorf("redirected to %q, want %q", location, test.location)
+			}
+			expectSessions(t, app, test.left...)
+		})
+	}
+}
+
+func TestHandleSessionRevokeOthers(t *testing.T) {
+	app := newSessionTestApp(t)
+
+	response := postAs(t, app, "sess_current", "/account/sessions/revoke-others", url.Values{})
+	if response.Code != http.StatusFound {
+		t.Errorf("status = %d, want %d", response.Code, http.StatusFound)
+	}
+	expectSessions(t, app, "sess_current", "sess_other")
+
+	// The current device is still signed in
+	request := httptest.NewRequest("GET", "/account/sessions", nil)
+	request.AddCookie(&http.Cookie{Name: sessionCookieName, Value: app.signSessionID("sess_current")})
+	recorder := httptest.NewRecorder()
+	app.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("/account/sessions: status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// NewSQLiteDB opens the SQLite database file at the given path, which is
+// created if it doesn't exist. Timestamps are written in SQLite's own format,
+// so they can be read back into time.Time and compared in queries.
+func NewSQLiteDB(path string) (*DB, error) {
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_time_format=sqlite"
+	if path != ":memory:" {
+		dsn += "&_pragma=journal_mode(WAL)"
+	}
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every connection to an in-memory database opens a new, empty one
+	if path == ":memory:" {
+		db.SetMaxOpenConns(1)
+	}
+
+	return &DB{
+		DB:      db,
+		Dialect: sqliteDialect{},
+	}, db.Ping()
+}
+
+// sqliteDialect implements the Dialect interface for SQLite
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+func (sqliteDialect) Replace(table string, columns ...string) string {
+	return replaceStatement("INSERT OR REPLACE", table, columns)
+}
+
+func (sqliteDialect) LimitOffset() string {
+	return "LIMIT ? OFFSET ?"
+}
+
+// Timestamp converts the time to UTC, as SQLite compares timestamps as text
+func (sqliteDialect) Timestamp(t time.Time) time.Time {
+	return t.UTC()
+}
+
+func (sqliteDialect) IsDuplicateKeyError(err error) bool {
+	sqliteErr, ok := err.(*sqlite.Error)
+	if !ok {
+		return false
+	}
+	code := sqliteErr.Code()
+	return code == sqlite3.SQLITE_CONSTRAINT_UNIQUE || code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
+
+func (sqliteDialect) TableSchema(conn *sql.Conn, table string) (map[string]bool, map[string]bool, error) {
+	columns, err := queryNames(conn, "SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	indexes, err := queryNames(conn, "SELECT name FROM pragma_index_list(?)", table)
+	return columns, indexes, err
+}
+
+// Lock starts an immediate transaction, which takes SQLite's database wide
+// write lock until it is committed or rolled back. As SQLite's schema changes
+// are transactional, a failed migration leaves no trace.
+func (sqliteDialect) Lock(conn *sql.Conn, name string, timeout time.Duration) (func(bool), error) {
+	ctx := context.Background()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE")
+		if err == nil {
+			break
+		}
+		if !strings.Contains(err.Error(), "locked") && !strings.Contains(err.Error(), "busy") {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return func(commit bool) {
+		if commit {
+			conn.ExecContext(ctx, "COMMIT")
+		} else {
+			conn.ExecContext(ctx, "ROLLBACK")
+		}
+	}, nil
+}
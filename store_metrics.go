@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var errStoreUnsupported = errors.New("store doesn't support this operation")
+
+// instrumentStores returns a copy of the stores which records the latency of
+// every store operation in the metrics
+func instrumentStores(stores *Stores, metrics *Metrics) *Stores {
+	instrumented := *stores
+	instrumented.Users = &instrumentedUserStore{store: stores.Users, metrics: metrics}
+	instrumented.Sessions = &instrumentedSessionStore{store: stores.Sessions, metrics: metrics}
+	instrumented.Images = &instrumentedImageStore{store: stores.Images, metrics: metrics}
+	return &instrumented
+}
+
+// instrumentedUserStore records the latencies of a UserStore
+type instrumentedUserStore struct {
+	store   UserStore
+	metrics *Metrics
+}
+
+func (store *instrumentedUserStore) Find(id string) (user *User, err error) {
+	defer store.observe("find", time.Now(), &err)
+	return store.store.Find(id)
+}
+
+func (store *instrumentedUserStore) FindByEmail(email string) (user *User, err error) {
+	defer store.observe("find_by_email", time.Now(), &err)
+	return store.store.FindByEmail(email)
+}
+
+func (store *instrumentedUserStore) FindByUsername(username string) (user *User, err error) {
+	defer store.observe("find_by_username", time.Now(), &err)
+	return store.store.FindByUsername(username)
+}
+
+func (store *instrumentedUserStore) Save(user User) (err error) {
+	defer store.observe("save", time.Now(), &err)
+	return store.store.Save(user)
+}
+
+func (store *instrumentedUserStore) observe(operation string, start time.Time, err *error) {
+	store.metrics.ObserveStore("users", operation, start, *err)
+}
+
+// instrumentedSessionStore records the latencies of a SessionStore. The
+// optional interfaces of the wrapped store are passed through.
+type instrumentedSessionStore struct {
+	store   SessionStore
+	metrics *Metrics
+}
+
+func (store *instrumentedSessionStore) Find(id string) (session *Session, err error) {
+	defer store.observe("find", time.Now(), &err)
+	return store.store.Find(id)
+}
+
+func (store *instrumentedSessionStore) Save(session *Session) (err error) {
+	defer store.observe("save", time.Now(), &err)
+	return store.store.Save(session)
+}
+
+func (store *instrumentedSessionStore) Delete(session *Session) (err error) {
+	defer store.observe("delete", time.Now(), &err)
+	return store.store.Delete(session)
+}
+
+func (store *instrumentedSessionStore) FindAllByUser(userID string) (sessions []Session, err error) {
+	defer store.observe("find_all_by_user", time.Now(), &err)
+	return store.store.FindAllByUser(userID)
+}
+
+func (store *instrumentedSessionStore) DeleteAllByUser(userID, exceptID string) (deleted int64, err error) {
+	defer store.observe("delete_all_by_user", time.Now(), &err)
+	return store.store.DeleteAllByUser(userID, exceptID)
+}
+
+func (store *instrumentedSessionStore) DeleteExpired(before time.Time) (deleted int64, err error) {
+	deleter, ok := store.store.(ExpiredSessionDeleter)
+	if !ok {
+		return 0, errStoreUnsupported
+	}
+
+	defer store.observe("delete_expired", time.Now(), &err)
+	return deleter.DeleteExpired(before)
+}
+
+func (store *instrumentedSessionStore) CountActive(now time.Time) (sessions, users int64, err error) {
+	counter, ok := store.store.(ActiveSessionCounter)
+	if !ok {
+		return 0, 0, errStoreUnsupported
+	}
+
+	defer store.observe("count_active", time.Now(), &err)
+	return counter.CountActive(now)
+}
+
+func (store *instrumentedSessionStore) observe(operation string, start time.Time, err *error) {
+	store.metrics.ObserveStore("sessions", operation, start, *err)
+}
+
+// instrumentedImageStore records the latencies of an ImageStore
+type instrumentedImageStore struct {
+	store   ImageStore
+	metrics *Metrics
+}
+
+func (store *instrumentedImageStore) Save(image *Image) (err error) {
+	defer store.observe("save", time.Now(), &err)
+	return store.store.Save(image)
+}
+
+func (store *instrumentedImageStore) Find(id string) (image *Image, err error) {
+	defer store.observe("find", time.Now(), &err)
+	return store.store.Find(id)
+}
+
+func (store *instrumentedImageStore) FindAll(offset, limit int) (images []Image, err error) {
+	defer store.observe("find_all", time.Now(), &err)
+	return store.store.FindAll(offset, limit)
+}
+
+func (store *instrumentedImageStore) FindAllByUser(user *User, offset, limit int) (images []Image, err error) {
+	defer store.observe("find_all_by_user", time.Now(), &err)
+	return store.store.FindAllByUser(user, offset, limit)
+}
+
+func (store *instrumentedImageStore) observe(operation string, start time.Time, err *error) {
+	store.metrics.ObserveStore("images", operation, start, *err)
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The store conformance suite runs every implementation of a store interface
+// through the same cases, so they all behave the same
+
+// newTestDB returns a migrated, in-memory SQLite database
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+
+	db, err := NewSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = migrator.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+var userStores = []struct {
+	name string
+	open func(t *testing.T) UserStore
+}{
+	{"file", func(t *testing.T) UserStore {
+		store, err := NewFileUserStore(filepath.Join(t.TempDir(), "users.yaml"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}},
+	{"sql", func(t *testing.T) UserStore {
+		return NewDBUserStore(newTestDB(t), nil)
+	}},
+	{"memory", func(t *testing.T) UserStore {
+		return NewMemoryUserStore()
+	}},
+}
+
+var sessionStores = []struct {
+	name string
+	open func(t *testing.T) SessionStore
+}{
+	{"file", func(t *testing.T) SessionStore {
+		store, err := NewFileSessionStore(filepath.Join(t.TempDir(), "sessions.yaml"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}},
+	{"sql", func(t *testing.T) SessionStore {
+		return NewDBSessionStore(newTestDB(t), nil)
+	}},
+	{"memory", func(t *testing.T) SessionStore {
+		return NewMemorySessionStore()
+	}},
+}
+
+var imageStores = []struct {
+	name string
+	open func(t *testing.T) ImageStore
+}{
+	{"sql", func(t *testing.T) ImageStore {
+		return NewDBImageStore(newTestDB(t), nil)
+	}},
+	{"memory", func(t *testing.T) ImageStore {
+		return NewMemoryImageStore()
+	}},
+}
+
+func TestUserStores(t *testing.T) {
+	for _, impl := range userStores {
+		t.Run(impl.name, func(t *testing.T) {
+			t.Run("not found", func(t *testing.T) {
+				store := impl.open(t)
+				for name, find := range map[string]func(string) (*User, error){
+					"Find":           store.Find,
+					"FindByUsername": store.FindByUsername,
+					"FindByEmail":    store.FindByEmail,
+				} {
+					user, err := find("missing")
+					if user != nil || err != nil {
+						t.Errorf("%s = %v, %v, want nil, nil", name, user, err)
+					}
+				}
+			})
+
+			t.Run("case insensitive lookups", func(t *testing.T) {
+				store := impl.open(t)
+				mustSaveUser(t, store, User{ID: "usr_1", Username: "Alice", Email: "Alice@Example.com"})
+
+				user, err := store.FindByUsername("aLICE")
+				if err != nil || user == nil || user.ID != "usr_1" {
+					t.Errorf("FindByUsername = %v, %v, want usr_1", user, err)
+				}
+				user, err = store.FindByEmail("alice@example.COM")
+				if err != nil || user == nil || user.ID != "usr_1" {
+					t.Errorf("FindByEmail = %v, %v, want usr_1", user, err)
+				}
+				if user != nil && (user.Username != "Alice" || user.Email != "Alice@Example.com") {
+					t.Errorf("found %s <%s>, want the original spelling", user.Username, user.Email)
+				}
+			})
+
+			t.Run("update", func(t *testing.T) {
+				store := impl.open(t)
+				mustSaveUser(t, store, User{ID: "usr_1", Username: "alice", Email: "alice@example.com"})
+				mustSaveUser(t, store, User{ID: "usr_1", Username: "alice", Email: "alice@example.org"})
+
+				user, err := store.Find("usr_1")
+				if err != nil || user == nil || user.Email != "alice@example.org" {
+					t.Errorf("Find = %v, %v, want the updated email", user, err)
+				}
+				user, err = store.FindByEmail("alice@example.com")
+				if user != nil || err != nil {
+					t.Errorf("FindByEmail(old email) = %v, %v, want nil, nil", user, err)
+				}
+			})
+
+			t.Run("duplicates", func(t *testing.T) {
+				store := impl.open(t)
+				mustSaveUser(t, store, User{ID: "usr_1", Username: "alice", Email: "alice@example.com"})
+
+				err := store.Save(User{ID: "usr_2", Username: "ALICE", Email: "other@example.com"})
+				if err != errUsernameExists {
+					t.Errorf("Save(duplicate username) = %v, want %v", err, errUsernameExists)
+				}
+				err = store.Save(User{ID: "usr_3", Username: "bob", Email: "ALICE@example.com"})
+				if err != errEmailExists {
+					t.Errorf("Save(duplicate email) = %v, want %v", err, errEmailExists)
+				}
+			})
+
+			t.Run("folding rule", func(t *testing.T) {
+				// The long s upper-cases to S, but doesn't lower-case to s.
+				// Every store has to agree on whether these names clash.
+				store := impl.open(t)
+				mustSaveUser(t, store, User{ID: "usr_1", Username: "sam", Email: "sam@example.com"})
+				err := store.Save(User{ID: "usr_2", Username: "ſam", Email: "ſam@example.com"})
+				if err != nil {
+					t.Errorf("Save(ſam) = %v, want nil", err)
+				}
+			})
+		})
+	}
+}
+
+func mustSaveUser(t *testing.T, store UserStore, user User) {
+	t.Helper()
+	err := store.Save(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionStores(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	for _, impl := range sessionStores {
+		t.Run(impl.name, func(t *testing.T) {
+			t.Run("not found", func(t *testing.T) {
+				store := impl.open(t)
+				session, err := store.Find("missing")
+				if session != nil || err != nil {
+					t.Errorf("Find = %v, %v, want nil, nil", session, err)
+				}
+			})
+
+			t.Run("save, find and delete", func(t *testing.T) {
+				store := impl.open(t)
+				saved := &Session{
+					ID:         "sess_1",
+					UserID:     "usr_1",
+					Expiry:     now.Add(time.Hour),
+					CSRFToken:  "token",
+					UserAgent:  "test",
+					IP:         "192.0.2.1",
+					LastSeen:   now,
+					CreatedAt:  now,
+					Persistent: true,
+				}
+				mustSaveSession(t, store, saved)
+
+				session, err := store.Find("sess_1")
+				if err != nil || session == nil {
+					t.Fatalf("Find = %v, %v", session, err)
+				}
+				if session.UserID != saved.UserID || session.CSRFToken != saved.CSRFToken ||
+					session.UserAgent != saved.UserAgent || session.IP != saved.IP ||
+					!session.Expiry.Equal(saved.Expiry) || !session.LastSeen.Equal(saved.LastSeen) ||
+					!session.CreatedAt.Equal(saved.CreatedAt) || !session.Persistent {
+					t.Errorf("Find = %+v, want %+v", session, saved)
+				}
+
+				err = store.Delete(saved)
+				if err != nil {
+					t.Fatal(err)
+				}
+				session, err = store.Find("sess_1")
+				if session != nil || err != nil {
+					t.Errorf("Find after Delete = %v, %v, want nil, nil", session, err)
+				}
+			})
+
+			t.Run("by user", func(t *testing.T) {
+				store := impl.open(t)
+				for i, id := range []string{"sess_1", "sess_2", "sess_3"} {
+					mustSaveSession(t, store, &Session{
+						ID:       id,
+						UserID:   "usr_1",
+						Expiry:   now.Add(time.Hour),
+						LastSeen: now.Add(time.Duration(i) * time.Minute),
+					})
+				}
+				mustSaveSession(t, store, &Session{ID: "sess_other", UserID: "usr_2", Expiry: now.Add(time.Hour)})
+
+				sessions, err := store.FindAllByUser("usr_1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ids := sessionIDs(sessions); ids != "sess_3 sess_2 sess_1" {
+					t.Errorf("FindAllByUser = %s, want the most recently seen first", ids)
+				}
+
+				deleted, err := store.DeleteAllByUser("usr_1", "sess_2")
+				if err != nil || deleted != 2 {
+					t.Errorf("DeleteAllByUser = %d, %v, want 2", deleted, err)
+				}
+				sessions, _ = store.FindAllByUser("usr_1")
+				if ids := sessionIDs(sessions); ids != "sess_2" {
+					t.Errorf("FindAllByUser after DeleteAllByUser = %s, want sess_2", ids)
+				}
+				session, _ := store.Find("sess_other")
+				if session == nil {
+					t.Error("DeleteAllByUser deleted another user's session")
+				}
+			})
+
+			t.Run("expiry", func(t *testing.T) {
+				store := impl.open(t)
+				mustSaveSession(t, store, &Session{ID: "sess_1", UserID: "usr_1", Expiry: now.Add(-time.Minute)})
+				mustSaveSession(t, store, &Session{ID: "sess_2", UserID: "usr_1", Expiry: now.Add(time.Hour)})
+				mustSaveSession(t, store, &Session{ID: "sess_3", UserID: "usr_2", Expiry: now.Add(time.Hour)})
+				mustSaveSession(t, store, &Session{ID: "sess_4", Expiry: now.Add(time.Hour)})
+
+				sessions, users, err := store.(ActiveSessionCounter).CountActive(now)
+				if err != nil || sessions != 3 || users != 2 {
+					t.Errorf("CountActive = %d, %d, %v, want 3, 2", sessions, users, err)
+				}
+
+				deleted, err := store.(ExpiredSessionDeleter).DeleteExpired(now)
+				if err != nil || deleted != 1 {
+					t.Errorf("DeleteExpired = %d, %v, want 1", deleted, err)
+				}
+				session, _ := store.Find("sess_1")
+				if session != nil {
+					t.Error("DeleteExpired kept the expired session")
+				}
+			})
+		})
+	}
+}
+
+func mustSaveSession(t *testing.T, store SessionStore, session *Session) {
+	t.Helper()
+	err := store.Save(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sessionIDs(sessions []Session) string {
+	ids := ""
+	for i, session := range sessions {
+		if i > 0 {
+			ids += " "
+		}
+		ids += session.ID
+	}
+	return ids
+}
+
+func TestImageStores(t *testing.T) {
+	created := time.Now().UTC().Truncate(time.Second)
+	alice := &User{ID: "usr_alice"}
+	bob := &User{ID: "usr_bob"}
+
+	for _, impl := range imageStores {
+		t.Run(impl.name, func(t *testing.T) {
+			t.Run("not found", func(t *testing.T) {
+				store := impl.open(t)
+				image, err := store.Find("missing")
+				if image != nil || err != nil {
+					t.Errorf("Find = %v, %v, want nil, nil", image, err)
+				}
+			})
+
+			t.Run("save and find", func(t *testing.T) {
+				store := impl.open(t)
+				saved := &Image{
+					ID:          "img_1",
+					UserID:      alice.ID,
+					Name:        "gopher.png",
+					Location:    "img_1.png",
+					Size:        1234,
+					MimeType:    "image/png",
+					Width:       640,
+					Height:      480,
+					CreatedAt:   created,
+					Description: "A gopher",
+					Variants:    ImageVariants{"thumb": {Width: 150, Height: 150}},
+				}
+				err := store.Save(saved)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				image, err := store.Find("img_1")
+				if err != nil || image == nil {
+					t.Fatalf("Find = %v, %v", image, err)
+				}
+				if image.UserID != saved.UserID || image.Name != saved.Name || image.Location != saved.Location ||
+					image.Size != saved.Size || image.MimeType != saved.MimeType || image.Width != saved.Width ||
+					image.Height != saved.Height || !image.CreatedAt.Equal(saved.CreatedAt) ||
+					image.Description != saved.Description || image.Variants["thumb"] != saved.Variants["thumb"] {
+					t.Errorf("Find = %+v, want %+v", image, saved)
+				}
+			})
+
+			t.Run("pagination", func(t *testing.T) {
+				store := impl.open(t)
+				// img_0 is the oldest, every other image belongs to bob
+				for i := 0; i < 6; i++ {
+					owner := alice
+					if i%2 == 1 {
+						owner = bob
+					}
+					err := store.Save(&Image{
+						ID:        "img_" + string(rune('0'+i)),
+						UserID:    owner.ID,
+						Location:  "img.png",
+						CreatedAt: created.Add(time.Duration(i) * time.Minute),
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				tests := []struct {
+					name          string
+					user          *User
+					offset, limit int
+					want          string
+				}{
+					{"first page", nil, 0, 2, "img_5 img_4"},
+					{"second page", nil, 2, 2, "img_3 img_2"},
+					{"last page", nil, 4, 3, "img_1 img_0"},
+					{"beyond the end", nil, 6, 2, ""},
+					{"user's first page", alice, 0, 2, "img_4 img_2"},
+					{"user's last page", alice, 2, 2, "img_0"},
+					{"other user", bob, 0, 10, "img_5 img_3 img_1"},
+					{"user without images", &User{ID: "usr_nobody"}, 0, 10, ""},
+				}
+				for _, test := range tests {
+					var images []Image
+					var err error
+					if test.user == nil {
+						images, err = store.FindAll(test.offset, test.limit)
+					} else {
+						images, err = store.FindAllByUser(test.user, test.offset, test.limit)
+					}
+					if err != nil {
+						t.Fatalf("%s: %v", test.name, err)
+					}
+					if images == nil {
+						t.Errorf("%s: got nil, want an empty slice", test.name)
+					}
+					if ids := imageIDs(images); ids != test.want {
+						t.Errorf("%s: got %q, want %q", test.name, ids, test.want)
+					}
+				}
+			})
+		})
+	}
+}
+
+func imageIDs(images []Image) string {
+	ids := ""
+	for i, image := range images {
+		if i > 0 {
+			ids += " "
+		}
+		ids += image.ID
+	}
+	return ids
+}
+
+func TestImportUsers(t *testing.T) {
+	from, err := NewFileUserStore(filepath.Join(t.TempDir(), "users.yaml"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustSaveUser(t, from, User{ID: "usr_1", Username: "Alice", Email: "alice@example.com", HashedPassword: "hash"})
+	mustSaveUser(t, from, User{ID: "usr_2", Username: "bob", Email: "bob@example.com"})
+
+	to := NewDBUserStore(newTestDB(t), nil)
+	// Importing twice updates the users imported before
+	for i := 0; i < 2; i++ {
+		imported, err := ImportUsers(from, to)
+		if err != nil || imported != 2 {
+			t.Fatalf("ImportUsers = %d, %v, want 2", imported, err)
+		}
+	}
+
+	user, err := to.FindByUsername("alice")
+	if err != nil || user == nil || user.ID != "usr_1" || user.HashedPassword != "hash" {
+		t.Errorf("FindByUsername = %+v, %v, want the imported user", user, err)
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
+	"strings"
 )
 
 var errorTemplate = `
@@ -22,29 +24,65 @@ var layoutFuncs = template.FuncMap{
 	},
 }
 
-var layout = template.Must(template.New("layout.html").Funcs(layoutFuncs).ParseFiles("templates/layout.html"))
-
 // RenderTemplate executes the template with the given name or returns an error page
-func RenderTemplate(w http.ResponseWriter, r *http.Request, name string, data map[string]interface{}) {
+func (app *App) RenderTemplate(w http.ResponseWriter, r *http.Request, name string, data map[string]interface{}) {
 	if data == nil {
 		data = map[string]interface{}{}
 	}
 
 	data["CurrentUser"] = RequestUser(r)
+	data["CSRFToken"] = app.CSRFToken(r)
 	data["Flash"] = r.URL.Query().Get("flash")
 
 	funcs := template.FuncMap{
 		"yield": func() (template.HTML, error) {
 			buf := bytes.NewBuffer(nil)
-			err := templates.ExecuteTemplate(buf, name, data)
+			err := app.templates.ExecuteTemplate(buf, name, data)
 			return template.HTML(buf.String()), err
 		},
 	}
 
-	layoutClone, _ := layout.Clone()
+	layoutClone, _ := app.layout.Clone()
 	layoutClone.Funcs(funcs)
 	err := layoutClone.Execute(w, data)
 	if err != nil {
 		http.Error(w, fmt.Sprintf(errorTemplate, name, err), http.StatusInternalServerError)
 	}
 }
+
+// RenderError responds with the error page of the given status code. API
+// clients asking for JSON get a JSON error object instead.
+func (app *App) RenderError(w http.ResponseWriter, r *http.Request, status int) {
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":      http.StatusText(status),
+			"status":     status,
+			"request_id": RequestID(r),
+		})
+		return
+	}
+
+	name := fmt.Sprintf("errors/%d", status)
+	if app.templates.Lookup(name) == nil {
+		name = "errors/500"
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	app.RenderTemplate(w, r, name, map[string]interface{}{
+		"RequestID": RequestID(r),
+	})
+}
+
+// NotFound responds with the 404 error page
+func (app *App) NotFound(w http.ResponseWriter, r *http.Request) {
+	app.RenderError(w, r, http.StatusNotFound)
+}
+
+// wantsJSON returns true if the client prefers a JSON response over HTML
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
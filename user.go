@@ -10,15 +10,16 @@ type User struct {
 	Username       string
 }
 
-const (
-	passwordLength = 8
-	hashCost       = 10
-	userIDLength
-)
+// ShowRoute returns the path of the user's image gallery
+func (user *User) ShowRoute() string {
+	return "/user/" + user.ID
+}
+
+const userIDLength = 10
 
 // NewUser creates a new user account record, validates the user input
 // and hashes the password
-func NewUser(username, email, password string) (User, error) {
+func (app *App) NewUser(username, email, password string) (User, error) {
 	user := User{
 		Email:    email,
 		Username: username,
@@ -32,12 +33,12 @@ func NewUser(username, email, password string) (User, error) {
 	if password == "" {
 		return user, errNoPassword
 	}
-	if len(password) < passwordLength {
+	if len(password) < app.Config.PasswordLength {
 		return user, errPasswordTooShort
 	}
 
 	// Check if the username exists
-	existingUser, err := globalUserStore.FindByUsername(username)
+	existingUser, err := app.Users.FindByUsername(username)
 	if err != nil {
 		return user, err
 	}
@@ -46,7 +47,7 @@ func NewUser(username, email, password string) (User, error) {
 	}
 
 	// Check if the email exists
-	existingUser, err = globalUserStore.FindByEmail(email)
+	existingUser, err = app.Users.FindByEmail(email)
 	if err != nil {
 		return user, err
 	}
@@ -54,7 +55,7 @@ func NewUser(username, email, password string) (User, error) {
 		return user, errEmailExists
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), hashCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), app.Config.HashCost)
 	user.HashedPassword = string(hashedPassword)
 	user.ID = GenerateID("usr", userIDLength)
 	return user, err
@@ -64,13 +65,13 @@ func NewUser(username, email, password string) (User, error) {
 // If both are matched the user and no error (nil) will be returned, if the user isn't found
 // or the password doesn't match a newly created user will be returned with the
 // form's values filled in and an errCredentialsIncorrect will that indicate a mismatch
-func FindUser(username, password string) (*User, error) {
+func (app *App) FindUser(username, password string) (*User, error) {
 	out := &User{
 		Username: username,
 	}
 
 	// find the user
-	existingUser, err := globalUserStore.FindByUsername(username)
+	existingUser, err := app.Users.FindByUsername(username)
 	if err != nil {
 		return out, err
 	}
@@ -89,13 +90,13 @@ func FindUser(username, password string) (*User, error) {
 }
 
 // UpdateUser updates the User record with a new email and password
-func UpdateUser(user *User, email, currentPassword, newPassword string) (User, error) {
+func (app *App) UpdateUser(user *User, email, currentPassword, newPassword string) (User, error) {
 	// create shallow copy from user
 	out := *user
 	out.Email = email
 
 	// Check if the email exists
-	existingUser, err := globalUserStore.FindByEmail(email)
+	existingUser, err := app.Users.FindByEmail(email)
 	if err != nil {
 		return out, err
 	}
@@ -123,11 +124,11 @@ func UpdateUser(user *User, email, currentPassword, newPassword string) (User, e
 		return out, nil
 	}
 
-	if len(newPassword) < passwordLength {
+	if len(newPassword) < app.Config.PasswordLength {
 		return out, errPasswordTooShort
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), hashCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), app.Config.HashCost)
 	user.HashedPassword = string(hashedPassword)
 	return out, err
 }
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"database/sql"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/go-yaml/yaml"
 )
@@ -17,42 +21,49 @@ type UserStore interface {
 	Save(User) error
 }
 
-// FileUserStore is a file storage implementation of the UserStore interface
+// FileUserStore is a file storage implementation of the UserStore interface,
+// which is safe for concurrent use
 type FileUserStore struct {
+	mutex    sync.RWMutex
 	filename string
+	logger   *Logger
 	Users    map[string]User
 }
 
-var globalUserStore UserStore
-
 // Save stores the user records on file
-func (store FileUserStore) Save(user User) error {
-	store.Users[user.ID] = user
+func (store *FileUserStore) Save(user User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 
-	// contents, err := json.MarshalIndent(store, "", "  ")
-	contents, err := yaml.Marshal(store)
+	err := checkUniqueUser(store.Users, user)
 	if err != nil {
 		return err
 	}
+	store.Users[user.ID] = user
+	store.logger.Debug("user saved", "user_id", user.ID)
 
-	err = ioutil.WriteFile(store.filename, contents, 0660)
+	// contents, err := json.MarshalIndent(store, "", "  ")
+	contents, err := yaml.Marshal(store)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	return writeFileAtomic(store.filename, contents, 0660)
 }
 
 // NewFileUserStore loads the user records from file or returns an empty one
 // if the file does not exist
-func NewFileUserStore(filename string) (*FileUserStore, error) {
+func NewFileUserStore(filename string, logger *Logger) (*FileUserStore, error) {
 	store := &FileUserStore{
 		Users:    map[string]User{},
 		filename: filename,
+		logger:   logger,
 	}
 	contents, err := ioutil.ReadFile(filename)
 	if err != nil {
 		// if the file doesn't exist we return the fresh instance
 		if os.IsNotExist(err) {
+			logger.Info("user file not found, starting empty", "file", filename)
 			return store, nil
 		}
 		return nil, err
@@ -61,11 +72,15 @@ func NewFileUserStore(filename string) (*FileUserStore, error) {
 	if err != nil {
 		return nil, err
 	}
+	logger.Info("users loaded", "file", filename, "count", len(store.Users))
 	return store, nil
 }
 
 // Find returns the user with the given id or nil if not found
-func (store FileUserStore) Find(id string) (*User, error) {
+func (store *FileUserStore) Find(id string) (*User, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
 	user, ok := store.Users[id]
 	if ok {
 		return &user, nil
@@ -74,12 +89,16 @@ func (store FileUserStore) Find(id string) (*User, error) {
 }
 
 // FindByUsername returns the user with the given username or nil if not found
-func (store FileUserStore) FindByUsername(username string) (*User, error) {
+func (store *FileUserStore) FindByUsername(username string) (*User, error) {
 	if username == "" {
 		return nil, nil
 	}
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
 	for _, user := range store.Users {
-		if strings.ToLower(username) == strings.ToLower(user.Username) {
+		if foldCase(username) == foldCase(user.Username) {
 			return &user, nil
 		}
 	}
@@ -87,12 +106,263 @@ func (store FileUserStore) FindByUsername(username string) (*User, error) {
 }
 
 // FindByEmail returns the user with the given email address or nil if not found
-func (store FileUserStore) FindByEmail(email string) (*User, error) {
+func (store *FileUserStore) FindByEmail(email string) (*User, error) {
 	if email == "" {
 		return nil, nil
 	}
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
 	for _, user := range store.Users {
-		if strings.ToLower(email) == strings.ToLower(user.Email) {
+		if foldCase(email) == foldCase(user.Email) {
+			return &user, nil
+		}
+	}
+	return nil, nil
+}
+
+// ImportUsers copies the users of the file store into another store, users
+// which exist there already are updated. It returns the number of users.
+func ImportUsers(from *FileUserStore, to UserStore) (int, error) {
+	from.mutex.RLock()
+	defer from.mutex.RUnlock()
+
+	ids := make([]string, 0, len(from.Users))
+	for id := range from.Users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for i, id := range ids {
+		user := from.Users[id]
+		err := to.Save(user)
+		if err != nil {
+			return i, fmt.Errorf("Importing user %s (%s) failed: %s", user.Username, user.ID, err)
+		}
+	}
+	return len(ids), nil
+}
+
+// DBUserStore is a database implementation of the UserStore interface.
+// Usernames and email addresses are stored case-folded next to the original
+// values, so lookups use the unique indexes on these columns.
+type DBUserStore struct {
+	db     *DB
+	logger *Logger
+}
+
+// NewDBUserStore returns a newly created DBUserStore on the given database
+func NewDBUserStore(db *DB, logger *Logger) UserStore {
+	return &DBUserStore{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// Save inserts or updates the user in the database. Taken usernames or
+// email addresses are reported by the database's unique indexes.
+func (store *DBUserStore) Save(user User) error {
+	result, err := store.db.Exec(`
+	UPDATE users
+	SET username = ?, username_folded = ?, email = ?, email_folded = ?, hashed_password = ?
+	WHERE id = ?
+	`,
+		user.Username,
+		foldCase(user.Username),
+		user.Email,
+		foldCase(user.Email),
+		user.HashedPassword,
+		user.ID,
+	)
+	if err != nil {
+		return store.userStoreError(err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated > 0 {
+		store.logger.Debug("user updated", "user_id", user.ID)
+		return nil
+	}
+
+	_, err = store.db.Exec(`
+	INSERT INTO users
+	  (id, username, username_folded, email, email_folded, hashed_password)
+	VALUES
+	  (?, ?, ?, ?, ?, ?)
+	`,
+		user.ID,
+		user.Username,
+		foldCase(user.Username),
+		user.Email,
+		foldCase(user.Email),
+		user.HashedPassword,
+	)
+	if err != nil {
+		return store.userStoreError(err)
+	}
+	store.logger.Debug("user created", "user_id", user.ID)
+	return nil
+}
+
+// Find returns the user with the given id or nil if not found
+func (store *DBUserStore) Find(id string) (*User, error) {
+	return store.findBy("id", id)
+}
+
+// FindByUsername returns the user with the given username or nil if not found
+func (store *DBUserStore) FindByUsername(username string) (*User, error) {
+	if username == "" {
+		return nil, nil
+	}
+	return store.findBy("username_folded", foldCase(username))
+}
+
+// FindByEmail returns the user with the given email address or nil if not found
+func (store *DBUserStore) FindByEmail(email string) (*User, error) {
+	if email == "" {
+		return nil, nil
+	}
+	return store.findBy("email_folded", foldCase(email))
+}
+
+// findBy returns the user whose column matches the value or nil if not found.
+// The column is never user supplied.
+func (store *DBUserStore) findBy(column, value string) (*User, error) {
+	row := store.db.QueryRow(`
+	SELECT id, username, email, hashed_password
+	FROM users
+	WHERE `+column+` = ?
+	`,
+		value,
+	)
+
+	user := User{}
+	err := row.Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.HashedPassword,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// userStoreError translates violations of the unique indexes into
+// validation errors
+func (store *DBUserStore) userStoreError(err error) error {
+	if !store.db.Dialect.IsDuplicateKeyError(err) {
+		return err
+	}
+
+	switch {
+	case strings.Contains(err.Error(), "username_folded"):
+		return errUsernameExists
+	case strings.Contains(err.Error(), "email_folded"):
+		return errEmailExists
+	}
+	return err
+}
+
+// foldCase returns the form usernames and email addresses are compared in.
+// All user stores share it, so they agree on which names clash, and the
+// DBUserStore stores it in the *_folded columns.
+func foldCase(value string) string {
+	return strings.ToLower(value)
+}
+
+// checkUniqueUser makes sure no other user has the same username or email,
+// the same way the unique indexes of the DBUserStore do
+func checkUniqueUser(users map[string]User, user User) error {
+	for _, existing := range users {
+		if existing.ID == user.ID {
+			continue
+		}
+		if foldCase(existing.Username) == foldCase(user.Username) {
+			return errUsernameExists
+		}
+		if foldCase(existing.Email) == foldCase(user.Email) {
+			return errEmailExists
+		}
+	}
+	return nil
+}
+
+// MemoryUserStore is an in-memory implementation of the UserStore interface,
+// which is safe for concurrent use. It's meant for tests and development.
+type MemoryUserStore struct {
+	mutex sync.RWMutex
+	users map[string]User
+}
+
+// NewMemoryUserStore returns an empty MemoryUserStore
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users: map[string]User{},
+	}
+}
+
+// Save stores the user in memory
+func (store *MemoryUserStore) Save(user User) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err := checkUniqueUser(store.users, user)
+	if err != nil {
+		return err
+	}
+	store.users[user.ID] = user
+	return nil
+}
+
+// Find returns the user with the given id or nil if not found
+func (store *MemoryUserStore) Find(id string) (*User, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	user, ok := store.users[id]
+	if !ok {
+		return nil, nil
+	}
+	return &user, nil
+}
+
+// FindByUsername returns the user with the given username or nil if not found
+func (store *MemoryUserStore) FindByUsername(username string) (*User, error) {
+	if username == "" {
+		return nil, nil
+	}
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	for _, user := range store.users {
+		if foldCase(username) == foldCase(user.Username) {
+			return &user, nil
+		}
+	}
+	return nil, nil
+}
+
+// FindByEmail returns the user with the given email address or nil if not found
+func (store *MemoryUserStore) FindByEmail(email string) (*User, error) {
+	if email == "" {
+		return nil, nil
+	}
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	for _, user := range store.users {
+		if foldCase(email) == foldCase(user.Email) {
 			return &user, nil
 		}
 	}